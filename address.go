@@ -0,0 +1,583 @@
+package message
+
+import (
+	"bytes"
+	"golang.org/x/net/idna"
+	"strings"
+)
+
+// An email address, with an optional display name, or a group of addresses
+// (RFC 5322 section 3.4).
+type Address struct {
+	// Display name, in UTF-8. It is quoted or encoded as needed when formatted.
+	Name string
+
+	// The address itself (addr-spec), like "john@example.com". The local part is quoted
+	// if needed when formatted. Empty for groups.
+	Addr string
+
+	// Members of the group, if the address is a group.
+	Group []*Address
+}
+
+// Create a new address. name may be empty.
+func NewAddress(name, addr string) *Address {
+	return &Address{Name: name, Addr: addr}
+}
+
+// Create a new group of addresses, like "Undisclosed recipients:;". members may be empty.
+func NewGroup(name string, members ...*Address) *Address {
+	return &Address{Name: name, Group: members}
+}
+
+// Returns true if the address is a group of addresses.
+func (a *Address) IsGroup() bool {
+	return a.Addr == ""
+}
+
+// Format the address for use in an header, encoding the display name with EncodePhrase
+// and converting internationalized domain names to Punycode. Addresses which can't be
+// downgraded (because their local part contains non-ascii characters) are formatted in
+// UTF-8.
+func (a *Address) String() string {
+	s, err := a.Format(false)
+	if err != nil {
+		s, _ = a.Format(true)
+	}
+	return s
+}
+
+// Format the address for use in an header.
+//
+// If utf8Headers is false, the address is formatted for classic SMTP: the display name
+// is encoded with EncodePhrase, internationalized domain names are converted to
+// Punycode (A-labels) and CannotDowngradeAddress is returned if the local part contains
+// non-ascii characters.
+//
+// If utf8Headers is true, the address is formatted according to RFC 6532, for use with
+// SMTPUTF8 servers: the display name and the address are written in UTF-8.
+func (a *Address) Format(utf8Headers bool) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	err := a.format(buf, utf8Headers)
+	return buf.String(), err
+}
+
+func (a *Address) format(buf *bytes.Buffer, utf8Headers bool) error {
+	if a.IsGroup() {
+		buf.WriteString((&WordEncoder{UTF8: utf8Headers}).EncodePhrase(a.Name))
+		buf.WriteString(":")
+		for i, member := range a.Group {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(" ")
+			if err := member.format(buf, utf8Headers); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(";")
+		return nil
+	}
+
+	addr, err := formatAddrSpec(a.Addr, utf8Headers)
+	if err != nil {
+		return err
+	}
+	if a.Name == "" {
+		buf.WriteString(addr)
+		return nil
+	}
+	buf.WriteString((&WordEncoder{UTF8: utf8Headers}).EncodePhrase(a.Name))
+	buf.WriteString(" <")
+	buf.WriteString(addr)
+	buf.WriteString(">")
+	return nil
+}
+
+// Returns true if s is a dot-atom (RFC 5322 section 3.2.3). If utf8Headers is true,
+// non-ascii characters are allowed (RFC 6532).
+func isDotAtom(s string, utf8Headers bool) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '.' && !isAtext(s[i]) && !(utf8Headers && s[i] >= 0x80) {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Quote the local part of an addr-spec if it's not a dot-atom, and convert the domain
+// to Punycode if utf8Headers is false
+func formatAddrSpec(addr string, utf8Headers bool) (string, error) {
+	at := strings.LastIndex(addr, "@")
+	if at == -1 {
+		return addr, nil
+	}
+	local, domain := addr[:at], addr[at+1:]
+
+	if !utf8Headers && !isASCII(local) {
+		return "", CannotDowngradeAddress
+	}
+	if !isDotAtom(local, utf8Headers) {
+		local = quoteString(local)
+	}
+
+	if !utf8Headers && !isASCII(domain) && !strings.HasPrefix(domain, "[") {
+		var err error
+		if domain, err = idna.Lookup.ToASCII(domain); err != nil {
+			return "", InvalidAddress
+		}
+	}
+	return local + "@" + domain, nil
+}
+
+// A list of addresses, as found in To, Cc or Reply-To headers.
+type AddressList []*Address
+
+// Format the list for use in an header, like Address.String. Addresses are separated
+// by ", ", so that Message.Read can fold long lists between them.
+func (l AddressList) String() string {
+	s, err := l.Format(false)
+	if err != nil {
+		s, _ = l.Format(true)
+	}
+	return s
+}
+
+// Format the list for use in an header, like Address.Format.
+func (l AddressList) Format(utf8Headers bool) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	for i, a := range l {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		if err := a.format(buf, utf8Headers); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// Set an address header (like From, To or Cc), replacing any existing value.
+// Addresses are formatted when the message is written, according to UTF8Headers ; in
+// the meantime, Headers contains them formatted as with AddressList.String. If an
+// address can't be formatted (see Address.Format), Read will return a HeaderError.
+// Returns self.
+func (m *Message) SetAddresses(name string, addrs ...*Address) *Message {
+	m.setLazyHeader(name, addrs, func(utf8Headers bool) (string, error) {
+		return AddressList(addrs).Format(utf8Headers)
+	})
+	return m
+}
+
+// Append addresses to an address header, creating it if needed.
+// Returns self.
+func (m *Message) AddAddresses(name string, addrs ...*Address) *Message {
+	if len(addrs) == 0 {
+		return m
+	}
+	if f := m.lazyHeader(name); f != nil && f.addrs != nil {
+		return m.SetAddresses(name, append(append([]*Address(nil), f.addrs...), addrs...)...)
+	}
+	old := m.Headers.Get(name)
+	if old == "" {
+		return m.SetAddresses(name, addrs...)
+	}
+	m.setLazyHeader(name, addrs, func(utf8Headers bool) (string, error) {
+		val, err := AddressList(addrs).Format(utf8Headers)
+		return old + ", " + val, err
+	})
+	return m
+}
+
+// Set the From header. Returns self.
+func (m *Message) SetFrom(addrs ...*Address) *Message {
+	return m.SetAddresses("From", addrs...)
+}
+
+// Set the To header. Returns self.
+func (m *Message) SetTo(addrs ...*Address) *Message {
+	return m.SetAddresses("To", addrs...)
+}
+
+// Add recipients to the To header. Returns self.
+func (m *Message) AddTo(addrs ...*Address) *Message {
+	return m.AddAddresses("To", addrs...)
+}
+
+// Set the Cc header. Returns self.
+func (m *Message) SetCc(addrs ...*Address) *Message {
+	return m.SetAddresses("Cc", addrs...)
+}
+
+// Add recipients to the Cc header. Returns self.
+func (m *Message) AddCc(addrs ...*Address) *Message {
+	return m.AddAddresses("Cc", addrs...)
+}
+
+// Set the Reply-To header. Returns self.
+func (m *Message) SetReplyTo(addrs ...*Address) *Message {
+	return m.SetAddresses("Reply-To", addrs...)
+}
+
+// Parse a single address (mailbox or group), like the value of a From header.
+// See ParseAddressList.
+func ParseAddress(s string) (*Address, error) {
+	l, err := ParseAddressList(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(l) != 1 {
+		return nil, InvalidAddress
+	}
+	return l[0], nil
+}
+
+// Parse an address-list (the value of To, Cc or Reply-To headers) as defined by
+// RFC 5322, including the obsolete syntax: groups, comments, quoted local parts, routes
+// ("<@relay.example:john@example.com>", which are discarded), empty list elements and
+// phrases containing dots. Encoded-words in display names are decoded, and UTF-8
+// (RFC 6532) is accepted, in particular in internationalized domain names.
+//
+// When a mailbox has no display name but is followed by a comment, like in
+// "john@example.com (John Smith)", the comment is used as display name.
+func ParseAddressList(s string) (AddressList, error) {
+	p := &addrParser{s: s}
+	l, err := p.parseList(false)
+	if err != nil {
+		return nil, err
+	}
+	p.skipCFWS()
+	if !p.empty() {
+		return nil, InvalidAddress
+	}
+	return l, nil
+}
+
+type addrParser struct {
+	s       string
+	pos     int
+	comment string // content of the last comment skipped
+}
+
+func (p *addrParser) empty() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *addrParser) peek() byte {
+	if p.empty() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *addrParser) consume(c byte) bool {
+	if p.peek() != c || p.empty() {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+// Skip folding whitespace and comments
+func (p *addrParser) skipCFWS() error {
+	p.comment = ""
+	for !p.empty() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '(':
+			if err := p.skipComment(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (p *addrParser) skipComment() error {
+	buf := bytes.NewBuffer(nil)
+	depth := 0
+	for !p.empty() {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && !p.empty():
+			buf.WriteByte(p.s[p.pos])
+			p.pos++
+			continue
+		case c == '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case c == ')':
+			depth--
+			if depth == 0 {
+				p.comment = strings.TrimSpace(buf.String())
+				return nil
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return InvalidAddress
+}
+
+// atext, plus UTF-8 characters (RFC 6532)
+func isAtextUTF8(c byte) bool {
+	return isAtext(c) || c >= 0x80
+}
+
+// Parse an atom, or a dot-atom if dot is true. Returns "" if there is none.
+func (p *addrParser) parseAtom(dot bool) string {
+	start := p.pos
+	for !p.empty() && (isAtextUTF8(p.peek()) || (dot && p.peek() == '.')) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// Parse a quoted-string, returning its unquoted content. The opening quote has
+// already been consumed.
+func (p *addrParser) parseQuotedString() (string, error) {
+	buf := bytes.NewBuffer(nil)
+	for !p.empty() {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '\\':
+			if p.empty() {
+				return "", InvalidAddress
+			}
+			buf.WriteByte(p.s[p.pos])
+			p.pos++
+		case '"':
+			return buf.String(), nil
+		case '\r', '\n':
+			// Unfolding
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", InvalidAddress
+}
+
+// Parse a word (atom or quoted-string), with surrounding CFWS. Also accepts dots, as
+// in obs-phrase and obs-local-part. quoted is true if the word was a quoted-string.
+func (p *addrParser) parseWord(dot bool) (word string, quoted bool, err error) {
+	if err = p.skipCFWS(); err != nil {
+		return "", false, err
+	}
+	if p.consume('"') {
+		word, err = p.parseQuotedString()
+		quoted = true
+	} else {
+		word = p.parseAtom(dot)
+	}
+	if err == nil {
+		err = p.skipCFWS()
+	}
+	return word, quoted, err
+}
+
+// Parse a phrase (display name), decoding encoded-words. Encoded-words are not
+// recognized inside quoted-strings (RFC 2047 section 5), so only runs of atoms are
+// decoded.
+func (p *addrParser) parsePhrase() (string, error) {
+	decoder := &WordDecoder{Lenient: true}
+	var words, atoms []string
+	decodeAtoms := func() error {
+		if len(atoms) > 0 {
+			decoded, err := decoder.DecodeHeader(strings.Join(atoms, " "))
+			if err != nil {
+				return err
+			}
+			words, atoms = append(words, decoded), nil
+		}
+		return nil
+	}
+	for {
+		word, quoted, err := p.parseWord(true)
+		if err != nil {
+			return "", err
+		}
+		if word == "" && !quoted {
+			break
+		}
+		if !quoted {
+			atoms = append(atoms, word)
+			continue
+		}
+		if err = decodeAtoms(); err != nil {
+			return "", err
+		}
+		words = append(words, word)
+	}
+	if err := decodeAtoms(); err != nil {
+		return "", err
+	}
+	return strings.Join(words, " "), nil
+}
+
+// Parse an addr-spec
+func (p *addrParser) parseAddrSpec() (string, error) {
+	// local-part, which may be made of several words in the obsolete syntax
+	local := ""
+	for {
+		word, quoted, err := p.parseWord(false)
+		if err != nil {
+			return "", err
+		}
+		if word == "" && !quoted {
+			return "", InvalidAddress
+		}
+		local += word
+		if !p.consume('.') {
+			break
+		}
+		local += "."
+	}
+
+	if !p.consume('@') {
+		return "", InvalidAddress
+	}
+
+	// domain
+	if err := p.skipCFWS(); err != nil {
+		return "", err
+	}
+	var domain string
+	if p.consume('[') {
+		end := strings.IndexByte(p.s[p.pos:], ']')
+		if end == -1 {
+			return "", InvalidAddress
+		}
+		domain = "[" + p.s[p.pos:p.pos+end] + "]"
+		p.pos += end + 1
+	} else {
+		for {
+			atom := p.parseAtom(false)
+			if atom == "" {
+				return "", InvalidAddress
+			}
+			domain += atom
+			if err := p.skipCFWS(); err != nil {
+				return "", err
+			}
+			if !p.consume('.') {
+				break
+			}
+			domain += "."
+			if err := p.skipCFWS(); err != nil {
+				return "", err
+			}
+		}
+	}
+	return local + "@" + domain, nil
+}
+
+// Parse an angle-addr, whose opening "<" has already been consumed
+func (p *addrParser) parseAngleAddr() (string, error) {
+	// obs-route: skip it
+	if err := p.skipCFWS(); err != nil {
+		return "", err
+	}
+	if p.peek() == '@' || p.peek() == ',' {
+		end := strings.IndexByte(p.s[p.pos:], ':')
+		if end == -1 {
+			return "", InvalidAddress
+		}
+		p.pos += end + 1
+	}
+
+	addr, err := p.parseAddrSpec()
+	if err != nil {
+		return "", err
+	}
+	if !p.consume('>') {
+		return "", InvalidAddress
+	}
+	return addr, nil
+}
+
+// Parse an address-list (or a group-list, if inGroup is true)
+func (p *addrParser) parseList(inGroup bool) (AddressList, error) {
+	var l AddressList
+	for {
+		if err := p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		if p.empty() || (inGroup && p.peek() == ';') {
+			return l, nil
+		}
+		// Empty elements are allowed by the obsolete syntax
+		if p.consume(',') {
+			continue
+		}
+
+		a, err := p.parseAddress(inGroup)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, a)
+
+		if err = p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		if !p.consume(',') {
+			return l, nil
+		}
+	}
+}
+
+// Parse a mailbox, or a group if inGroup is false
+func (p *addrParser) parseAddress(inGroup bool) (*Address, error) {
+	// Try a bare addr-spec first
+	start := p.pos
+	if addr, err := p.parseAddrSpec(); err == nil {
+		if p.empty() || p.peek() == ',' || p.peek() == ';' {
+			return &Address{Name: p.comment, Addr: addr}, nil
+		}
+	}
+	p.pos = start
+
+	name, err := p.parsePhrase()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.consume('<'):
+		addr, err := p.parseAngleAddr()
+		if err != nil {
+			return nil, err
+		}
+		return &Address{Name: name, Addr: addr}, nil
+	case !inGroup && name != "" && p.consume(':'):
+		members, err := p.parseList(true)
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(';') {
+			return nil, InvalidAddress
+		}
+		if members == nil {
+			members = AddressList{}
+		}
+		return &Address{Name: name, Group: members}, nil
+	}
+	return nil, InvalidAddress
+}
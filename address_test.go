@@ -0,0 +1,183 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+var addressData = []struct {
+	addr      *Address
+	formatted string
+}{
+	{NewAddress("", "john@example.com"), "john@example.com"},
+	{NewAddress("John Smith", "john@example.com"), "John Smith <john@example.com>"},
+	{NewAddress("Smith, John", "john@example.com"), "\"Smith, John\" <john@example.com>"},
+	{NewAddress("John \"Johnny\" (Jr) Smith", "john@example.com"), "\"John \\\"Johnny\\\" (Jr) Smith\" <john@example.com>"},
+	{NewAddress("田中", "tanaka@example.com"), "=?UTF-8?B?55Sw5Lit?= <tanaka@example.com>"},
+	{NewAddress("", "john smith@example.com"), "\"john smith\"@example.com"},
+	{NewGroup("Undisclosed recipients"), "Undisclosed recipients:;"},
+	{NewGroup("Team", NewAddress("", "a@example.com"), NewAddress("B", "b@example.com")), "Team: a@example.com, B <b@example.com>;"},
+}
+
+func TestAddress(t *testing.T) {
+	for _, data := range addressData {
+		if formatted := data.addr.String(); formatted != data.formatted {
+			t.Errorf("Address %#v should be formatted as %#v, got %#v", data.addr, data.formatted, formatted)
+		}
+	}
+}
+
+func TestMessageAddresses(t *testing.T) {
+	m := NewBinaryMessage(bytes.NewBufferString(""))
+	m.SetFrom(NewAddress("Miller", "miller@example.com"))
+	m.SetTo(NewAddress("田中", "tanaka@example.com"))
+	m.AddCc(NewAddress("Smith, John", "john@example.com"))
+	m.AddCc(NewAddress("", "jane@example.com"))
+	m.SetReplyTo(NewGroup("Nobody"))
+
+	expected := map[string]string{
+		"From":     "Miller <miller@example.com>",
+		"To":       "=?UTF-8?B?55Sw5Lit?= <tanaka@example.com>",
+		"Cc":       "\"Smith, John\" <john@example.com>, jane@example.com",
+		"Reply-To": "Nobody:;",
+	}
+	for name, val := range expected {
+		if m.Headers.Get(name) != val {
+			t.Errorf("%s is %#v, expected %#v", name, m.Headers.Get(name), val)
+		}
+	}
+}
+
+func TestAddressListFolding(t *testing.T) {
+	var l AddressList
+	for i := 0; i < 10; i++ {
+		l = append(l, NewAddress("Recipient, Number", "recipient@example.com"))
+	}
+	m := NewBinaryMessage(bytes.NewBufferString(""))
+	m.SetTo(l...)
+	for _, line := range strings.Split(readAll(t, m), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Line %#v is longer than 78 characters", line)
+		}
+	}
+}
+
+var parseAddressListData = []struct {
+	list     string
+	expected AddressList
+}{
+	{"john@example.com", AddressList{NewAddress("", "john@example.com")}},
+	{"John Smith <john@example.com>", AddressList{NewAddress("John Smith", "john@example.com")}},
+	{"\"Smith, John\" <john@example.com>, jane@example.com",
+		AddressList{NewAddress("Smith, John", "john@example.com"), NewAddress("", "jane@example.com")}},
+	{"=?UTF-8?B?55Sw5Lit?= <tanaka@example.com>", AddressList{NewAddress("田中", "tanaka@example.com")}},
+	{"=?ISO-8859-1?Q?Fran=E7ois?= Dupont <francois@example.com>", AddressList{NewAddress("François Dupont", "francois@example.com")}},
+	{"\"=?UTF-8?Q?a?=\" <x@y.z>", AddressList{NewAddress("=?UTF-8?Q?a?=", "x@y.z")}},
+	{"=?UTF-8?Q?Fran=C3=A7ois?= \"=?UTF-8?Q?b?=\" =?UTF-8?Q?c?= =?UTF-8?Q?d?= <x@y.z>", AddressList{NewAddress("François =?UTF-8?Q?b?= cd", "x@y.z")}},
+	{"john@example.com (John Smith)", AddressList{NewAddress("John Smith", "john@example.com")}},
+	{"John (the man) Smith <john (comment) @ example . com>", AddressList{NewAddress("John Smith", "john@example.com")}},
+	{"\"john smith\"@example.com", AddressList{NewAddress("", "john smith@example.com")}},
+	{"John <@relay1.example,@relay2.example:john@example.com>", AddressList{NewAddress("John", "john@example.com")}},
+	{"John Q. Public <john.q.public@example.com>", AddressList{NewAddress("John Q. Public", "john.q.public@example.com")}},
+	{"a@example.com,, ,b@example.com", AddressList{NewAddress("", "a@example.com"), NewAddress("", "b@example.com")}},
+	{"用户@例子.中国", AddressList{NewAddress("", "用户@例子.中国")}},
+	{"Müller <mueller@bücher.example>", AddressList{NewAddress("Müller", "mueller@bücher.example")}},
+	{"john@[192.0.2.1]", AddressList{NewAddress("", "john@[192.0.2.1]")}},
+	{"Undisclosed recipients:;", AddressList{NewGroup("Undisclosed recipients", AddressList{}...)}},
+	{"Team: a@example.com, B <b@example.com>;, c@example.com", AddressList{
+		NewGroup("Team", NewAddress("", "a@example.com"), NewAddress("B", "b@example.com")),
+		NewAddress("", "c@example.com")}},
+}
+
+func TestParseAddressList(t *testing.T) {
+	for _, data := range parseAddressListData {
+		l, err := ParseAddressList(data.list)
+		if err != nil {
+			t.Errorf("ParseAddressList(%#v) failed: %v", data.list, err)
+			continue
+		}
+		if l.String() != data.expected.String() || len(l) != len(data.expected) {
+			t.Errorf("ParseAddressList(%#v) should be %#v, got %#v", data.list, data.expected.String(), l.String())
+			continue
+		}
+		for i := range l {
+			if l[i].Name != data.expected[i].Name || l[i].Addr != data.expected[i].Addr || l[i].IsGroup() != data.expected[i].IsGroup() {
+				t.Errorf("ParseAddressList(%#v): address %d is %#v, expected %#v", data.list, i, l[i], data.expected[i])
+			}
+		}
+	}
+}
+
+func TestParseAddressListErrors(t *testing.T) {
+	for _, list := range []string{"john", "John <john@example.com", "Smith, John <john@example.com>", "a@example.com b@example.com", "(unterminated"} {
+		if l, err := ParseAddressList(list); err == nil {
+			t.Errorf("ParseAddressList(%#v) should fail, got %#v", list, l.String())
+		}
+	}
+}
+
+func TestParseAddressRoundTrip(t *testing.T) {
+	for _, data := range addressData {
+		a, err := ParseAddress(data.formatted)
+		if err != nil {
+			t.Errorf("ParseAddress(%#v) failed: %v", data.formatted, err)
+		} else if a.String() != data.formatted {
+			t.Errorf("ParseAddress(%#v) gives %#v", data.formatted, a.String())
+		}
+	}
+}
+
+func TestInternationalizedAddress(t *testing.T) {
+	a := NewAddress("Müller", "mueller@bücher.example")
+	if s, err := a.Format(false); err != nil || s != "=?UTF-8?Q?M=C3=BCller?= <mueller@xn--bcher-kva.example>" {
+		t.Errorf("Format(false) gives %#v, %v", s, err)
+	}
+	if s, err := a.Format(true); err != nil || s != "Müller <mueller@bücher.example>" {
+		t.Errorf("Format(true) gives %#v, %v", s, err)
+	}
+
+	a = NewAddress("用户, 张", "用户@例子.中国")
+	if _, err := a.Format(false); err != CannotDowngradeAddress {
+		t.Errorf("Format(false) should fail with CannotDowngradeAddress, got %v", err)
+	}
+	if s, err := a.Format(true); err != nil || s != "\"用户, 张\" <用户@例子.中国>" {
+		t.Errorf("Format(true) gives %#v, %v", s, err)
+	}
+}
+
+func TestMessageUTF8Addresses(t *testing.T) {
+	m := NewBinaryMessage(bytes.NewBufferString(""))
+	m.SetTo(NewAddress("", "用户@例子.中国"))
+	if _, err := io.ReadAll(m); !errors.Is(err, CannotDowngradeAddress) || err.(*HeaderError).Header != "To" {
+		t.Errorf("Read should fail with CannotDowngradeAddress for To, got %v", err)
+	}
+
+	// Replacing the header clears the error
+	m = NewBinaryMessage(bytes.NewBufferString(""))
+	m.SetTo(NewAddress("", "用户@例子.中国"))
+	m.SetTo(NewAddress("", "a@example.com"))
+	if !strings.Contains(readAll(t, m), "\r\nTo: a@example.com\r\n") {
+		t.Errorf("To header should be replaced")
+	}
+
+	// Set before UTF8Headers, formatted when written
+	m = NewBinaryMessage(bytes.NewBufferString(""))
+	m.SetFrom(NewAddress("", "user@bücher.example"))
+	m.AddTo(NewAddress("", "用户@例子.中国"))
+	m.AddTo(NewAddress("", "b@example.com"))
+	m.UTF8Headers = true
+	out := readAll(t, m)
+	if !strings.Contains(out, "\r\nFrom: user@bücher.example\r\n") || !strings.Contains(out, "\r\nTo: 用户@例子.中国, b@example.com\r\n") {
+		t.Errorf("Address headers should be written in UTF-8, got %#v", out)
+	}
+
+	m = NewBinaryMessage(bytes.NewBufferString(""))
+	m.UTF8Headers = true
+	m.SetTo(NewAddress("", "用户@例子.中国"))
+	if !strings.Contains(readAll(t, m), "\r\nTo: 用户@例子.中国\r\n") {
+		t.Errorf("To header should be written in UTF-8")
+	}
+}
@@ -0,0 +1,154 @@
+package message
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Description of a file attached to a message, see NewAttachment.
+type Attachment struct {
+	// Name of the file, without any directory. May contain non-ascii characters.
+	Filename string
+
+	// Use the inline disposition instead of attachment, for files which should be
+	// displayed with the message (like images referenced by an HTML part).
+	Inline bool
+
+	// Media type of the file. If nil, it's guessed from the extension of Filename, or
+	// from the first bytes of the file (application/octet-stream if there is no body).
+	MediaType *MediaType
+
+	// Size of the file in bytes, before encoding. Not written if zero.
+	Size int64
+
+	// Dates of creation and of last modification of the file. Not written if zero.
+	CreationDate     time.Time
+	ModificationDate time.Time
+}
+
+// Size of the data used to guess the media type (see http.DetectContentType)
+const sniffSize = 512
+
+// New message containing an attached file. It will be encoded with base64 encoding, so
+// that the file is received unchanged.
+//
+// The Content-Disposition header (RFC 2183) contains the file name, encoded according
+// to RFC 2231 if it's not ascii. Since some mail clients (notably old versions of
+// Outlook) don't support RFC 2231, the name is also given as an encoded-word in the
+// filename parameter and in the name parameter of Content-Type. Compliant clients use
+// the RFC 2231 form.
+//
+// If the media type has to be guessed from the content and body can't be read, Read
+// will return the error.
+func NewAttachment(a *Attachment, body io.Reader) *Message {
+	m := NewBinaryMessage(body)
+
+	mediaType := a.MediaType
+	if mediaType == nil {
+		mediaType, m.Body, m.err = guessMediaType(a.Filename, body)
+	}
+	m.SetHeader("Content-Type", mediaType.String()+filenameParams("name", a.Filename))
+
+	disposition := bytes.NewBufferString("attachment")
+	if a.Inline {
+		disposition.Reset()
+		disposition.WriteString("inline")
+	}
+	disposition.WriteString(filenameParams("filename", a.Filename))
+	if a.Size > 0 {
+		disposition.WriteString("; size=" + strconv.FormatInt(a.Size, 10))
+	}
+	if !a.CreationDate.IsZero() {
+		disposition.WriteString("; creation-date=" + quoteString(FormatDate(a.CreationDate)))
+	}
+	if !a.ModificationDate.IsZero() {
+		disposition.WriteString("; modification-date=" + quoteString(FormatDate(a.ModificationDate)))
+	}
+	m.SetHeader("Content-Disposition", disposition.String())
+
+	return m
+}
+
+// Add an attached file to the multipart message (see NewAttachment).
+// Returns self.
+func (m *MultipartMessage) Attach(a *Attachment, body io.Reader) *MultipartMessage {
+	return m.AddPart(NewAttachment(a, body))
+}
+
+// Format the parameter giving the file name of an attachment, including the leading
+// "; ". Non-ascii names are given both in the RFC 2231 and the encoded-word forms.
+func filenameParams(param, filename string) string {
+	if filename == "" {
+		return ""
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for _, p := range formatParam(param, filename, "") {
+		buf.WriteString("; ")
+		buf.WriteString(p)
+	}
+	if !isASCII(filename) {
+		// Legacy form, which is not split into continuations since clients using it
+		// don't support them
+		return "; " + param + "=" + quoteString(EncodeWord(filename)) + buf.String()
+	}
+	return buf.String()
+}
+
+// Guess the media type of a file from its name, or else from its first bytes. Returns
+// the media type and a reader giving the whole file. Without a body (a template for
+// Writer.CreatePart), application/octet-stream is used if the name doesn't help.
+func guessMediaType(filename string, body io.Reader) (*MediaType, io.Reader, error) {
+	if ext := path.Ext(filename); ext != "" {
+		if t := parseMediaType(mime.TypeByExtension(strings.ToLower(ext))); t != nil {
+			return t, body, nil
+		}
+	}
+	if body == nil {
+		return NewMediaType("application", "octet-stream"), nil, nil
+	}
+
+	var start int64
+	seeker, seekable := body.(io.Seeker)
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return NewMediaType("application", "octet-stream"), body, err
+		}
+	}
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return NewMediaType("application", "octet-stream"), body, err
+	}
+	head = head[:n]
+	mediaType := parseMediaType(http.DetectContentType(head))
+
+	// Keep the body rewindable if it is (see Message.Reset)
+	if seekable {
+		_, err = seeker.Seek(start, io.SeekStart)
+		return mediaType, body, err
+	}
+	return mediaType, io.MultiReader(bytes.NewReader(head), body), nil
+}
+
+// Parse a media type like "text/plain; charset=utf-8". Returns nil if s is empty or
+// invalid.
+func parseMediaType(s string) *MediaType {
+	mediaType, params, err := mime.ParseMediaType(s)
+	if err != nil {
+		return nil
+	}
+	slash := strings.IndexByte(mediaType, '/')
+	if slash == -1 {
+		return nil
+	}
+	return &MediaType{Type: mediaType[:slash], Subtype: mediaType[slash+1:], Params: params}
+}
@@ -0,0 +1,56 @@
+package message
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachment(t *testing.T) {
+	date := time.Date(2014, 3, 7, 9, 5, 0, 0, time.UTC)
+	m := NewAttachment(&Attachment{Filename: "report.pdf", Size: 3, ModificationDate: date}, bytes.NewBufferString("PDF"))
+	if ct := m.Headers.Get("Content-Type"); ct != "application/pdf; name=report.pdf" {
+		t.Errorf("Content-Type is %#v", ct)
+	}
+	expected := "attachment; filename=report.pdf; size=3; modification-date=\"Fri, 07 Mar 2014 09:05:00 +0000\""
+	if cd := m.Headers.Get("Content-Disposition"); cd != expected {
+		t.Errorf("Content-Disposition is %#v, expected %#v", cd, expected)
+	}
+
+	m = NewAttachment(&Attachment{Filename: "résumé.pdf", Inline: true}, bytes.NewBufferString("PDF"))
+	expected = "inline; filename=\"=?UTF-8?Q?r=C3=A9sum=C3=A9=2Epdf?=\"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf"
+	if cd := m.Headers.Get("Content-Disposition"); cd != expected {
+		t.Errorf("Content-Disposition is %#v, expected %#v", cd, expected)
+	}
+	expected = "application/pdf; name=\"=?UTF-8?Q?r=C3=A9sum=C3=A9=2Epdf?=\"; name*=UTF-8''r%C3%A9sum%C3%A9.pdf"
+	if ct := m.Headers.Get("Content-Type"); ct != expected {
+		t.Errorf("Content-Type is %#v, expected %#v", ct, expected)
+	}
+}
+
+func TestAttachmentSniffing(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 1000)
+	m := NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+	m.Attach(&Attachment{Filename: "image"}, bytes.NewBufferString(png))
+	m.Attach(&Attachment{Filename: "data", MediaType: NewMediaType("application", "x-custom")}, bytes.NewBufferString(""))
+	if ct := m.Parts[0].Headers.Get("Content-Type"); ct != "image/png; name=image" {
+		t.Errorf("Content-Type is %#v", ct)
+	}
+	if ct := m.Parts[1].Headers.Get("Content-Type"); ct != "application/x-custom; name=data" {
+		t.Errorf("Content-Type is %#v", ct)
+	}
+
+	// Template without body, see Writer.CreatePart
+	if ct := NewAttachment(&Attachment{Filename: "data.zzqx"}, nil).Headers.Get("Content-Type"); ct != "application/octet-stream; name=data.zzqx" {
+		t.Errorf("Content-Type is %#v", ct)
+	}
+
+	parsed, err := ParseMessage(bytes.NewBufferString(readAll(t, m)))
+	if err != nil {
+		t.Fatalf("Can't parse message: %v", err)
+	}
+	if body := readAll(t, parsed.Multipart().Parts[0].Body); body != png {
+		t.Errorf("Attachment body is altered")
+	}
+}
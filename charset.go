@@ -0,0 +1,71 @@
+package message
+
+import (
+	"bytes"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"strings"
+	"unicode/utf8"
+)
+
+// Returns the encoding for a charset name. IANA names and aliases are recognized,
+// as well as the labels used by web browsers (which are often found in the wild, like
+// "cp1252" or "x-sjis"). GB2312 is handled as its superset GBK.
+func lookupCharset(name string) (encoding.Encoding, error) {
+	if e, err := ianaindex.MIME.Encoding(name); err == nil && e != nil {
+		return e, nil
+	}
+	if e, err := htmlindex.Get(name); err == nil {
+		return e, nil
+	}
+	return nil, UnsupportedCharset
+}
+
+// Returns true if charset is UTF-8. US-ASCII is not included, since 8-bit data is not
+// valid in it: it's handled like other charsets, and transcoding fails for non-ascii
+// characters.
+func isUTF8Charset(charset string) bool {
+	return strings.EqualFold(charset, "utf-8")
+}
+
+// Convert text in the given charset to UTF-8. If lenient is false, an error is returned
+// for data containing invalid sequences ; otherwise they are replaced by U+FFFD.
+func decodeCharset(charset string, data []byte, lenient bool) (string, error) {
+	if isUTF8Charset(charset) {
+		if !utf8.Valid(data) {
+			if !lenient {
+				return "", InvalidEncodedWord
+			}
+			return strings.ToValidUTF8(string(data), "�"), nil
+		}
+		return string(data), nil
+	}
+
+	e, err := lookupCharset(charset)
+	if err != nil {
+		return "", err
+	}
+	decoded, err := e.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", err
+	}
+	if !lenient && replacedInvalidData(e, data, decoded) {
+		return "", InvalidEncodedWord
+	}
+	return string(decoded), nil
+}
+
+// Decoders of golang.org/x/text replace invalid sequences by U+FFFD instead of failing.
+// Returns true if decoded contains more U+FFFD than the encoded data of the charset.
+func replacedInvalidData(e encoding.Encoding, data, decoded []byte) bool {
+	n := bytes.Count(decoded, []byte("\uFFFD"))
+	if n == 0 {
+		return false
+	}
+	replacement, err := e.NewEncoder().Bytes([]byte("\uFFFD"))
+	if err != nil || len(replacement) == 0 {
+		return true
+	}
+	return n > bytes.Count(data, replacement)
+}
@@ -0,0 +1,203 @@
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+)
+
+// A WordDecoder decodes RFC 2047 encoded-words into UTF-8.
+type WordDecoder struct {
+	// By default, decoding is strict: encoded-words which are malformed, too long, use an
+	// unknown charset or contain invalid data make the decoding fail.
+	//
+	// In lenient mode, the decoder tries hard to make sense of broken real-world headers:
+	// encoded-words are also recognized when they are not separated from surrounding text
+	// by whitespace or when they contain spaces, base64 padding may be missing, invalid
+	// escapes and invalid UTF-8 sequences are kept as is (or replaced by U+FFFD), and
+	// encoded-words that still can't be decoded are left untouched.
+	Lenient bool
+}
+
+// Decode a single encoded-word (like "=?UTF-8?Q?caf=C3=A9?=") into UTF-8 in strict mode.
+// See WordDecoder.DecodeWord.
+func DecodeWord(w string) (string, error) {
+	return new(WordDecoder).DecodeWord(w)
+}
+
+// Decode all encoded-words of an header value into UTF-8 in strict mode.
+// See WordDecoder.DecodeHeader.
+func DecodeHeader(h string) (string, error) {
+	return new(WordDecoder).DecodeHeader(h)
+}
+
+// Decode a single encoded-word into UTF-8. Both Q and B encodings are supported, as well
+// as the charsets known to golang.org/x/text (ISO-8859-x, Windows-125x, ISO-2022-JP,
+// GB2312, KOI8-R, ...). RFC 2231 language specifications ("=?UTF-8*fr?Q?...?=") are
+// ignored.
+func (d *WordDecoder) DecodeWord(w string) (string, error) {
+	if !strings.HasPrefix(w, "=?") || !strings.HasSuffix(w, "?=") || len(w) < 8 {
+		return "", InvalidEncodedWord
+	}
+	if !d.Lenient && (len(w) > maxEncodedWordSize || strings.ContainsAny(w, " \t\r\n")) {
+		return "", InvalidEncodedWord
+	}
+
+	fields := strings.Split(w[2:len(w)-2], "?")
+	if len(fields) != 3 || fields[0] == "" || len(fields[1]) != 1 {
+		return "", InvalidEncodedWord
+	}
+
+	charset := fields[0]
+	if i := strings.IndexByte(charset, '*'); i != -1 {
+		charset = charset[:i]
+	}
+
+	var data []byte
+	var err error
+	switch fields[1] {
+	case "Q", "q":
+		data, err = d.decodeQ(fields[2])
+	case "B", "b":
+		data, err = d.decodeB(fields[2])
+	default:
+		err = InvalidEncodedWord
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return decodeCharset(charset, data, d.Lenient)
+}
+
+func (d *WordDecoder) decodeQ(s string) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '_':
+			buf.WriteByte(' ')
+		case s[i] == '=':
+			if i+2 < len(s) && isHexDigit(s[i+1]) && isHexDigit(s[i+2]) {
+				buf.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+				i += 2
+			} else if d.Lenient {
+				buf.WriteByte('=')
+			} else {
+				return nil, InvalidEncodedWord
+			}
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *WordDecoder) decodeB(s string) ([]byte, error) {
+	if !d.Lenient {
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, InvalidEncodedWord
+		}
+		return data, nil
+	}
+
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' || r == '=' {
+			return -1
+		}
+		return r
+	}, s)
+	data, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, InvalidEncodedWord
+	}
+	return data, nil
+}
+
+func isHexDigit(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+func unhex(b byte) byte {
+	switch {
+	case b >= '0' && b <= '9':
+		return b - '0'
+	case b >= 'a' && b <= 'f':
+		return b - 'a' + 10
+	}
+	return b - 'A' + 10
+}
+
+func isWSP(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// Returns the end (index after "?=") of the encoded-word candidate starting at
+// h[start:], or -1 if there is none.
+func (d *WordDecoder) wordEnd(h string, start int) int {
+	// charset, then encoding
+	i := start + 2
+	for n := 0; n < 2; n++ {
+		j := strings.IndexByte(h[i:], '?')
+		if j <= 0 || strings.ContainsAny(h[i:i+j], " \t\r\n") {
+			return -1
+		}
+		i += j + 1
+	}
+
+	// encoded text
+	j := strings.Index(h[i:], "?=")
+	if j == -1 || (!d.Lenient && strings.ContainsAny(h[i:i+j], " \t\r\n")) {
+		return -1
+	}
+	return i + j + 2
+}
+
+// Decode all encoded-words of an header value (typically an unstructured header like
+// Subject, or a display name) into UTF-8. Whitespace separating two adjacent
+// encoded-words is removed, as required by RFC 2047. Text which is not encoded is left
+// as is.
+//
+// In strict mode, only encoded-words delimited by whitespace are recognized, and an
+// error is returned if one of them can't be decoded.
+func (d *WordDecoder) DecodeHeader(h string) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	i, lastEnd := 0, -1
+	for i < len(h) {
+		start := strings.Index(h[i:], "=?")
+		if start == -1 {
+			break
+		}
+		start += i
+
+		end := d.wordEnd(h, start)
+		if end != -1 && !d.Lenient {
+			if (start > 0 && !isWSP(h[start-1])) || (end < len(h) && !isWSP(h[end])) {
+				end = -1
+			}
+		}
+
+		var decoded string
+		var err error
+		if end != -1 {
+			decoded, err = d.DecodeWord(h[start:end])
+			if err != nil && !d.Lenient {
+				return "", err
+			}
+		}
+		if end == -1 || err != nil {
+			// Not an encoded-word, output it as is
+			buf.WriteString(h[i : start+2])
+			i = start + 2
+			continue
+		}
+
+		if lastEnd == -1 || strings.Trim(h[lastEnd:start], " \t\r\n") != "" {
+			buf.WriteString(h[i:start])
+		}
+		buf.WriteString(decoded)
+		i, lastEnd = end, end
+	}
+	buf.WriteString(h[i:])
+	return buf.String(), nil
+}
@@ -0,0 +1,91 @@
+package message
+
+import (
+	"testing"
+)
+
+var decodeHeaderData = []struct{ encoded, decoded string }{
+	{"test", "test"},
+	{"=?UTF-8?Q?Bonjour_=C3=A0_tous!?=", "Bonjour à tous!"},
+	{"=?UTF-8?Q?=E7=94=B0=E4=B8=AD?= <tanaka@example.com>", "田中 <tanaka@example.com>"},
+	{"=?utf-8?b?5pio5pel44Gu5Lya6K2w?=", "昨日の会議"},
+	{"=?UTF-8*ja?B?55Sw5Lit?=", "田中"},
+	{"=?ISO-8859-1?Q?a?= =?ISO-8859-1?Q?b?=", "ab"},
+	{"=?ISO-8859-1?Q?a?=\r\n =?ISO-8859-1?Q?b?=", "ab"},
+	{"=?ISO-8859-1?Q?a?= b =?ISO-8859-1?Q?c?=", "a b c"},
+	{"=?ISO-8859-1?Q?Caf=E9?=", "Café"},
+	{"=?ISO-8859-15?Q?=A4?=", "€"},
+	{"=?windows-1252?Q?=80?=", "€"},
+	{"=?KOI8-R?B?8NLJ18XU?=", "Привет"},
+	{"=?ISO-2022-JP?B?GyRCRURDZhsoQg==?=", "田中"},
+	{"=?GB2312?B?1tDOxA==?=", "中文"},
+	{"=?UTF-16BE?Q?=FF=FD?=", "\uFFFD"},
+	{"foo=?UTF-8?Q?bar?=", "foo=?UTF-8?Q?bar?="},
+	{"=?UTF-8?Q?bar", "=?UTF-8?Q?bar"},
+}
+
+func TestDecodeHeader(t *testing.T) {
+	for _, data := range decodeHeaderData {
+		decoded, err := DecodeHeader(data.encoded)
+		if err != nil {
+			t.Errorf("DecodeHeader(%#v) failed: %v", data.encoded, err)
+		} else if decoded != data.decoded {
+			t.Errorf("DecodeHeader(%#v) should be %#v, got %#v", data.encoded, data.decoded, decoded)
+		}
+	}
+}
+
+func TestDecodeWordRoundTrip(t *testing.T) {
+	for _, data := range testData {
+		if data.encoded == data.decoded {
+			continue
+		}
+		decoded, err := DecodeWord(data.encoded)
+		if err != nil || decoded != data.decoded {
+			t.Errorf("DecodeWord(%#v) should be %#v, got %#v (%v)", data.encoded, data.decoded, decoded, err)
+		}
+	}
+}
+
+var decodeHeaderErrors = []string{
+	"=?UTF-8?Q?caf=C3=A?=",
+	"=?UTF-8?B?Y2Fmw6k?=",
+	"=?UTF-8?X?abc?=",
+	"=?X-UNKNOWN?Q?abc?=",
+	"=?UTF-8?Q?=FF?=",
+	"=?us-ascii?Q?caf=E9?=",
+	"=?Shift_JIS?Q?=82?=",
+	"=?ISO-2022-JP?B?GyRC/w==?=",
+	"=?UTF-16BE?Q?=D8=00?=",
+}
+
+var decodeHeaderLenientData = []struct{ encoded, decoded string }{
+	{"=?UTF-8?Q?caf=C3=A?=", "caf�=A"},
+	{"=?UTF-8?B?Y2Fmw6k?=", "café"},
+	{"=?X-UNKNOWN?Q?abc?=", "=?X-UNKNOWN?Q?abc?="},
+	{"foo=?UTF-8?Q?bar?=baz", "foobarbaz"},
+	{"=?UTF-8?Q?a?==?UTF-8?Q?b?=", "ab"},
+	{"=?UTF-8?Q?hello world?=", "hello world"},
+	{"=?x-sjis?B?k2OShg==?=", "田中"},
+	{"=?us-ascii?Q?caf=E9?=", "caf\uFFFD"},
+}
+
+func TestDecodeHeaderStrictErrors(t *testing.T) {
+	for _, encoded := range decodeHeaderErrors {
+		if decoded, err := DecodeHeader(encoded); err == nil {
+			t.Errorf("DecodeHeader(%#v) should fail, got %#v", encoded, decoded)
+		}
+	}
+}
+
+func TestDecodeHeaderLenient(t *testing.T) {
+	d := &WordDecoder{Lenient: true}
+	for _, data := range decodeHeaderLenientData {
+		decoded, err := d.DecodeHeader(data.encoded)
+		if err != nil {
+			t.Errorf("DecodeHeader(%#v) failed: %v", data.encoded, err)
+		} else if decoded != data.decoded {
+			t.Errorf("DecodeHeader(%#v) should be %#v, got %#v", data.encoded, data.decoded, decoded)
+		}
+	}
+}
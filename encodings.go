@@ -1,7 +1,9 @@
 package message
 
 import (
+	"bufio"
 	"bytes"
+	"github.com/sloonz/go-qprintable"
 	"io"
 )
 
@@ -37,6 +39,45 @@ type base64Reader struct {
 	remainingData []byte
 }
 
+// Counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Writes eol after each line of maxLineSize characters, like base64Reader
+type lineWrapper struct {
+	w        io.Writer
+	eol      []byte
+	lineSize int
+}
+
+func (w *lineWrapper) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := min(len(p), maxLineSize-w.lineSize)
+		nn, err := w.w.Write(p[:chunk])
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+		w.lineSize += chunk
+		if w.lineSize == maxLineSize {
+			if _, err = w.w.Write(w.eol); err != nil {
+				return n, err
+			}
+			w.lineSize = 0
+		}
+	}
+	return n, nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -86,3 +127,310 @@ func (r *base64Reader) Read(p []byte) (n int, err error) {
 
 	return n, nil
 }
+
+// Returns a reader decoding the data read from r according to the transfer encoding te.
+// For quoted-printable, qpEncoding defines the end of line characters hard line breaks are
+// converted to (see Message.QPEncoding) ; if nil, BinaryEncoding is assumed.
+// Encodings other than base64 and quoted-printable are returned as is.
+//
+// Decoders are tolerant: whitespace and invalid characters are ignored in base64 data,
+// missing padding is accepted, and in quoted-printable data, lowercase escapes, transport
+// padding before soft line breaks, bare LF line breaks and invalid escape sequences
+// (which are kept literally) are accepted.
+func NewTransferDecoder(te TransferEncoding, qpEncoding *qprintable.Encoding, r io.Reader) io.Reader {
+	switch te {
+	case TE_base64:
+		return &base64Decoder{body: r, buf: bytes.NewBuffer(nil), raw: make([]byte, 1024)}
+	case TE_qprintable:
+		if qpEncoding == nil {
+			qpEncoding = qprintable.BinaryEncoding
+		}
+		return qprintable.NewDecoder(qpEncoding, &qpLineReader{body: bufio.NewReader(r), buf: bytes.NewBuffer(nil)})
+	}
+	return r
+}
+
+func qpNativeEOL(enc *qprintable.Encoding) string {
+	switch enc {
+	case qprintable.UnixTextEncoding:
+		return "\n"
+	case qprintable.MacTextEncoding:
+		return "\r"
+	}
+	return "\r\n"
+}
+
+// Returns the line break of the canonical form defined by enc, or "" for BinaryEncoding
+func qpLineBreak(enc *qprintable.Encoding) string {
+	if enc == qprintable.BinaryEncoding {
+		return ""
+	}
+	return qpNativeEOL(enc)
+}
+
+// Statistics about a body, used to choose its transfer encoding
+type bodyScanner struct {
+	lineBreak   string // line break of the canonical form, "" if there is none
+	size        int64
+	escaped     int64 // bytes which can't be written as is in 7bit
+	nul         bool
+	lineSize    int
+	longestLine int
+	cr          bool // last byte was a CR, which may start a CRLF line break
+}
+
+func (s *bodyScanner) Write(p []byte) (int, error) {
+	for _, b := range p {
+		s.size++
+		if s.cr {
+			s.cr = false
+			if b == '\n' {
+				s.endLine()
+				continue
+			}
+			s.escaped++
+			s.lineSize++
+		}
+
+		switch {
+		case b == '\r' && s.lineBreak == "\r\n":
+			s.cr = true
+			continue
+		case (b == '\r' || b == '\n') && s.lineBreak == string(b):
+			s.endLine()
+			continue
+		case b == 0:
+			s.nul = true
+			s.escaped++
+		case b >= 0x7f || (b < ' ' && b != '\t'):
+			s.escaped++
+		}
+		s.lineSize++
+	}
+	return len(p), nil
+}
+
+func (s *bodyScanner) endLine() {
+	if s.lineSize > s.longestLine {
+		s.longestLine = s.lineSize
+	}
+	s.lineSize = 0
+}
+
+// Choose the transfer encoding of the scanned body. base64 is used when quoted-printable
+// would give a bigger result (each escaped byte takes 3 characters in quoted-printable,
+// base64 adds 1 character every 3 bytes).
+func (s *bodyScanner) transferEncoding() TransferEncoding {
+	if s.cr {
+		s.escaped++
+		s.cr = false
+	}
+	s.endLine()
+
+	switch {
+	case s.nul || 6*s.escaped > s.size:
+		return TE_base64
+	case s.escaped > 0 || s.longestLine > maxSMTPLineSize:
+		return TE_qprintable
+	}
+	return TE_7bit
+}
+
+// Converts the line breaks of the canonical form of a 7bit body to the end of line
+// characters of the message (or to CRLF for base64 text).
+type eolReader struct {
+	eol       string
+	lineBreak string
+	body      *bufio.Reader
+	buf       *bytes.Buffer
+}
+
+func (r *eolReader) Read(p []byte) (n int, err error) {
+	for len(p) > n {
+		if r.buf.Len() > 0 {
+			nn, _ := r.buf.Read(p[n:])
+			n += nn
+			continue
+		}
+
+		b, err := r.body.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if b == r.lineBreak[0] {
+			if len(r.lineBreak) == 1 {
+				r.buf.WriteString(r.eol)
+				continue
+			} else if next, _ := r.body.Peek(1); len(next) == 1 && next[0] == r.lineBreak[1] {
+				r.body.ReadByte()
+				r.buf.WriteString(r.eol)
+				continue
+			}
+		}
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
+
+// Same as eolReader, for data written by the caller (see Writer.CreatePart). Close must
+// be called at the end of the data, since a CR may be kept to see if it's followed by a
+// LF.
+type eolWriter struct {
+	w         io.Writer
+	eol       string
+	lineBreak string
+	cr        bool
+}
+
+func (w *eolWriter) Write(p []byte) (int, error) {
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		if w.cr {
+			w.cr = false
+			if b == '\n' {
+				buf.WriteString(w.eol)
+				continue
+			}
+			buf.WriteByte('\r')
+		}
+		switch {
+		case len(w.lineBreak) == 1 && b == w.lineBreak[0]:
+			buf.WriteString(w.eol)
+		case len(w.lineBreak) == 2 && b == '\r':
+			w.cr = true
+		default:
+			buf.WriteByte(b)
+		}
+	}
+	if _, err := w.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *eolWriter) Close() error {
+	if w.cr {
+		w.cr = false
+		_, err := io.WriteString(w.w, "\r")
+		return err
+	}
+	return nil
+}
+
+// Prepares quoted-printable data for qprintable.NewDecoder, which only recognizes CRLF
+// line breaks and doesn't remove transport padding: trailing whitespace is removed from
+// each line (RFC 2045 section 6.7, rule 3), and bare LF line breaks are converted to
+// CRLF. A final soft line break, which is not followed by a line break, is removed.
+// Escapes are left to the decoder.
+type qpLineReader struct {
+	body    *bufio.Reader
+	buf     *bytes.Buffer
+	padding []byte // trailing whitespace of a line which did not fit in body buffer
+	eof     bool
+}
+
+func (r *qpLineReader) Read(p []byte) (n int, err error) {
+	for r.buf.Len() == 0 {
+		if r.eof {
+			// Only return io.EOF without data, otherwise the decoder drops incomplete
+			// escape sequences
+			return 0, io.EOF
+		}
+		if err = r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+func (r *qpLineReader) fill() error {
+	data, err := r.body.ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	line := append(r.padding, data...)
+	r.padding = nil
+
+	switch {
+	case err == bufio.ErrBufferFull:
+		// Whitespace may be padding, which can only be known at the end of the line
+		trimmed := bytes.TrimRight(line, " \t")
+		r.buf.Write(trimmed)
+		r.padding = append([]byte(nil), line[len(trimmed):]...)
+	case err == io.EOF:
+		// A soft line break at the end of the data is not followed by a line break
+		r.buf.Write(bytes.TrimSuffix(bytes.TrimRight(line, " \t"), []byte("=")))
+		r.eof = true
+	default:
+		line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+		r.buf.Write(bytes.TrimRight(line, " \t"))
+		r.buf.WriteString("\r\n")
+	}
+	return nil
+}
+
+const base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+var base64DecodeMap [256]byte
+
+func init() {
+	for i := range base64DecodeMap {
+		base64DecodeMap[i] = 0xff
+	}
+	for i := 0; i < len(base64Alphabet); i++ {
+		base64DecodeMap[base64Alphabet[i]] = byte(i)
+	}
+}
+
+type base64Decoder struct {
+	body     io.Reader
+	buf      *bytes.Buffer
+	raw      []byte
+	quantum  [4]byte
+	quantumN int
+	eof      bool
+}
+
+func (r *base64Decoder) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for r.buf.Len() == 0 && !r.eof {
+		nn, rerr := r.body.Read(r.raw)
+		for _, c := range r.raw[:nn] {
+			if c == '=' {
+				// Padding ends the current quantum
+				r.flush()
+			} else if v := base64DecodeMap[c]; v != 0xff {
+				r.quantum[r.quantumN] = v
+				r.quantumN++
+				if r.quantumN == 4 {
+					r.flush()
+				}
+			}
+		}
+		if rerr == io.EOF {
+			r.flush()
+			r.eof = true
+		} else if rerr != nil {
+			return 0, rerr
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// Decode the current (possibly incomplete) quantum into buffer
+func (r *base64Decoder) flush() {
+	q := r.quantum
+	switch r.quantumN {
+	case 4:
+		r.buf.Write([]byte{q[0]<<2 | q[1]>>4, q[1]<<4 | q[2]>>2, q[2]<<6 | q[3]})
+	case 3:
+		r.buf.Write([]byte{q[0]<<2 | q[1]>>4, q[1]<<4 | q[2]>>2})
+	case 2:
+		r.buf.Write([]byte{q[0]<<2 | q[1]>>4})
+	}
+	r.quantumN = 0
+}
@@ -0,0 +1,46 @@
+package message
+
+import (
+	"github.com/sloonz/go-qprintable"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var transferDecoderData = []struct {
+	te               TransferEncoding
+	qpEncoding       *qprintable.Encoding
+	encoded, decoded string
+}{
+	{TE_qprintable, qprintable.UnixTextEncoding, MESSAGE_QENCODED, MESSAGE},
+	{TE_base64, nil, MESSAGE_B64ENCODED, MESSAGE},
+	{TE_base64, nil, "SGVs bG8s\r\n\tIHdv\r\ncmxkIQ", "Hello, world!"},
+	{TE_base64, nil, "SGVsbG8=\r\nLCB3b3JsZCE=", "Hello, world!"},
+	{TE_base64, nil, "SGVsbG8sIHdvcmxkIQ=", "Hello, world!"},
+	{TE_qprintable, qprintable.UnixTextEncoding, "caf=c3=a9 =  \r\nau lait  \r\nfin", "café au lait\nfin"},
+	{TE_qprintable, qprintable.WindowsTextEncoding, "a\nb=\nc", "a\r\nbc"},
+	{TE_qprintable, qprintable.BinaryEncoding, "1 + 1 = 2 =ZZ=", "1 + 1 = 2 =ZZ"},
+	{TE_qprintable, qprintable.WindowsTextEncoding, "a \t\nb=  \nc=\n", "a\r\nbc"},
+	{TE_qprintable, qprintable.BinaryEncoding, "=00=0D=0A\r\n=4", "\x00\r\n\r\n=4"},
+	{TE_7bit, nil, "as =3D is", "as =3D is"},
+}
+
+func TestTransferDecoder(t *testing.T) {
+	for _, data := range transferDecoderData {
+		r := NewTransferDecoder(data.te, data.qpEncoding, iotest.OneByteReader(strings.NewReader(data.encoded)))
+		if decoded := readAll(t, r); decoded != data.decoded {
+			t.Errorf("Decoding %#v: expected %#v, got %#v", data.encoded, data.decoded, decoded)
+		}
+	}
+}
+
+func TestTransferDecoderLongLine(t *testing.T) {
+	// Lines longer than the internal buffer, with escapes and spaces around the cut
+	encoded := strings.Repeat("abc=3D ", 2000) + "  \r\nend"
+	expected := strings.Repeat("abc= ", 2000)
+	expected = expected[:len(expected)-1] + "\nend"
+	r := NewTransferDecoder(TE_qprintable, qprintable.UnixTextEncoding, strings.NewReader(encoded))
+	if decoded := readAll(t, r); decoded != expected {
+		t.Errorf("Long line not correctly decoded")
+	}
+}
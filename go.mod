@@ -2,4 +2,8 @@ module github.com/sloonz/go-mime-message
 
 go 1.16
 
-require github.com/sloonz/go-qprintable v0.0.0-20160203160305-775b3a4592d5
+require (
+	github.com/sloonz/go-qprintable v0.0.0-20160203160305-775b3a4592d5
+	golang.org/x/net v0.18.0
+	golang.org/x/text v0.14.0
+)
@@ -0,0 +1,237 @@
+package message
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Error returned when an header can't be written, like an address header containing
+// an address which requires UTF8Headers (Err is then CannotDowngradeAddress).
+type HeaderError struct {
+	// Name of the header
+	Header string
+
+	Err error
+}
+
+func (e *HeaderError) Error() string {
+	return e.Header + ": " + e.Err.Error()
+}
+
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+// A header field
+type Field struct {
+	Name  string
+	Value string
+}
+
+// An ordered list of header fields. A field name may appear several times (for
+// example Received or Comments). Lookups are case-insensitive. Names are written with
+// the spelling given by the caller, except for some well-known fields whose
+// conventional spelling is used (like Message-ID or DKIM-Signature, see HeaderName).
+//
+// The zero value is an empty header, ready to use.
+type Header struct {
+	fields []Field
+}
+
+// Conventional spellings of field names which are not in the usual Word-Word form
+var wellKnownNames = map[string]string{
+	"arc-authentication-results": "ARC-Authentication-Results",
+	"arc-message-signature":      "ARC-Message-Signature",
+	"arc-seal":                   "ARC-Seal",
+	"content-id":                 "Content-ID",
+	"content-md5":                "Content-MD5",
+	"dkim-signature":             "DKIM-Signature",
+	"list-id":                    "List-ID",
+	"message-id":                 "Message-ID",
+	"mime-version":               "MIME-Version",
+	"resent-message-id":          "Resent-Message-ID",
+	"www-authenticate":           "WWW-Authenticate",
+	"x-mimeole":                  "X-MimeOLE",
+}
+
+// Returns the spelling used to write a field name: the conventional one for some
+// well-known fields (like "Message-ID", "MIME-Version", "DKIM-Signature" or
+// "Content-ID"), name as is otherwise.
+func HeaderName(name string) string {
+	if wellKnown, ok := wellKnownNames[strings.ToLower(name)]; ok {
+		return wellKnown
+	}
+	return name
+}
+
+// Append a field to the header, after all existing fields.
+func (h *Header) Add(name, value string) {
+	h.fields = append(h.fields, Field{HeaderName(name), value})
+}
+
+// Set the value of a field. The first field with this name is replaced in place and the
+// other ones are removed ; if there is none, the field is appended to the header.
+func (h *Header) Set(name, value string) {
+	name = HeaderName(name)
+	found := false
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			if found {
+				continue
+			}
+			f.Name, f.Value = name, value
+			found = true
+		}
+		fields = append(fields, f)
+	}
+	h.fields = fields
+	if !found {
+		h.fields = append(h.fields, Field{name, value})
+	}
+}
+
+// Returns the value of the first field with the given name, or "" if there is none.
+func (h *Header) Get(name string) string {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Returns the values of all fields with the given name, in order.
+func (h *Header) Values(name string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Remove all fields with the given name.
+func (h *Header) Del(name string) {
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.Name, name) {
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
+}
+
+// Returns the fields of the header, in order.
+func (h *Header) Fields() []Field {
+	return append([]Field(nil), h.fields...)
+}
+
+// Returns the number of fields in the header.
+func (h *Header) Len() int {
+	return len(h.fields)
+}
+
+// Returns true if name is a valid field name: printable ascii characters except colon
+// (RFC 5322 section 3.6.8)
+func validHeaderName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Returns true if value can be written in an header without changing the structure of
+// the message. Line breaks are only allowed when they fold the header, that is when
+// they are followed by whitespace and some text ; bare CR and LF, or line breaks which
+// would end the header, are not.
+func validHeaderValue(value, eol string) bool {
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case 0:
+			return false
+		case '\r', '\n':
+			if !strings.HasPrefix(value[i:], eol) {
+				return false
+			}
+			i += len(eol)
+			if i >= len(value) || (value[i] != ' ' && value[i] != '\t') {
+				return false
+			}
+			line := value[i:]
+			if end := strings.IndexAny(line, "\r\n"); end != -1 {
+				line = line[:end]
+			}
+			if strings.Trim(line, " \t") == "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Check that a field can be written in an header, see validHeaderName and
+// validHeaderValue.
+func validateField(f Field, eol string) error {
+	if !validHeaderName(f.Name) {
+		return InvalidHeaderName
+	}
+	if !validHeaderValue(f.Value, eol) {
+		return InvalidHeaderValue
+	}
+	return nil
+}
+
+// Maximum length of header lines, as recommended by RFC 5322
+const maxHeaderLineSize = 78
+
+// Format a header field, folding it at whitespace so that lines do not exceed 78
+// characters when possible. Whitespace inside quoted strings is not used for folding, and
+// since encoded-words can't contain whitespace, they are never broken. Values already
+// containing line breaks are left untouched.
+func foldHeader(name, value, eol string) string {
+	line := name + ": " + value
+	if len(line) <= maxHeaderLineSize || strings.ContainsAny(value, "\r\n") {
+		return line
+	}
+
+	buf := bytes.NewBufferString(name + ":")
+	lineSize := buf.Len()
+	inQuote, escaped := false, false
+	start := 0 // start of the chunk (whitespace + word) not yet written
+	value = " " + value
+	for i := 0; i <= len(value); i++ {
+		if i < len(value) {
+			c := value[i]
+			if escaped {
+				escaped = false
+				continue
+			} else if inQuote && c == '\\' {
+				escaped = true
+				continue
+			} else if c == '"' {
+				inQuote = !inQuote
+				continue
+			} else if inQuote || (c != ' ' && c != '\t') || (i > 0 && (value[i-1] == ' ' || value[i-1] == '\t')) {
+				continue
+			}
+		}
+
+		// value[start:i] is a complete chunk. Trailing whitespace stays on the current
+		// line, since a folded line can't contain only whitespace.
+		if i > start {
+			blank := strings.Trim(value[start:i], " \t") == ""
+			if lineSize+(i-start) > maxHeaderLineSize && lineSize > len(name)+1 && !blank {
+				buf.WriteString(eol)
+				lineSize = 0
+			}
+			buf.WriteString(value[start:i])
+			lineSize += i - start
+			start = i
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,146 @@
+package message
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	var h Header
+	h.Add("received", "from a")
+	h.Add("Subject", "first")
+	h.Add("Received", "from b")
+	h.Set("subject", "second")
+	h.Add("X-Mailer", "test")
+
+	expected := []Field{
+		{"received", "from a"},
+		{"subject", "second"},
+		{"Received", "from b"},
+		{"X-Mailer", "test"},
+	}
+	if !reflect.DeepEqual(h.Fields(), expected) {
+		t.Errorf("Fields are %#v, expected %#v", h.Fields(), expected)
+	}
+	if v := h.Values("RECEIVED"); !reflect.DeepEqual(v, []string{"from a", "from b"}) {
+		t.Errorf("Received values are %#v", v)
+	}
+	if h.Get("Received") != "from a" || h.Get("Comments") != "" {
+		t.Errorf("Unexpected Get results")
+	}
+
+	h.Set("Received", "from c")
+	h.Del("x-mailer")
+	expected = []Field{
+		{"Received", "from c"},
+		{"subject", "second"},
+	}
+	if !reflect.DeepEqual(h.Fields(), expected) {
+		t.Errorf("Fields are %#v, expected %#v", h.Fields(), expected)
+	}
+}
+
+func TestHeaderSpelling(t *testing.T) {
+	m := NewBinaryMessage(bytes.NewBufferString(""))
+	m.SetHeader("message-id", "<1@example.com>")
+	m.SetHeader("Dkim-Signature", "v=1")
+	m.SetHeader("Content-Id", "<2@example.com>")
+	m.SetHeader("X-lowercase-Header", "kept")
+	m.SetHeader("MESSAGE-ID", "<3@example.com>")
+
+	expected := "MIME-Version: 1.0\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Message-ID: <3@example.com>\r\n" +
+		"DKIM-Signature: v=1\r\n" +
+		"Content-ID: <2@example.com>\r\n" +
+		"X-lowercase-Header: kept\r\n" +
+		"\r\n"
+	if s := readAll(t, m); s != expected {
+		t.Errorf("Message is %#v, expected %#v", s, expected)
+	}
+	if m.Headers.Get("x-LOWERCASE-header") != "kept" {
+		t.Errorf("Lookups should be case-insensitive")
+	}
+}
+
+func TestHeaderOrder(t *testing.T) {
+	m := NewBinaryMessage(bytes.NewBufferString("x"))
+	m.Headers.Add("Received", "from a")
+	m.Headers.Add("Received", "from b")
+	m.SetHeader("Subject", "test")
+	m.SetHeader("Content-Type", "application/octet-stream")
+
+	expected := "MIME-Version: 1.0\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Received: from a\r\n" +
+		"Received: from b\r\n" +
+		"Subject: test\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"\r\n" +
+		"eA=="
+	if data := readAll(t, m); data != expected {
+		t.Errorf("Message is %#v, expected %#v", data, expected)
+	}
+}
+
+var foldHeaderData = []struct{ name, value, folded string }{
+	{"Subject", "short", "Subject: short"},
+	{"Subject", "Lorem ipsum dolor sit amet, consectetur adipiscing elit. Ut elit eros, viverra in laoreet nec",
+		"Subject: Lorem ipsum dolor sit amet, consectetur adipiscing elit. Ut elit\n" +
+			" eros, viverra in laoreet nec"},
+	{"To", "\"Lorem ipsum dolor sit amet, consectetur adipiscing elit\" <lorem@example.com>, ipsum@example.com",
+		"To: \"Lorem ipsum dolor sit amet, consectetur adipiscing elit\"\n" +
+			" <lorem@example.com>, ipsum@example.com"},
+	{"Subject", "=?UTF-8?Q?=E6=98=A8=E6=97=A5=E3=81=AE=E4=BC=9A=E8=AD=B0?= =?UTF-8?Q?=E6=98=A8=E6=97=A5=E3=81=AE=E4=BC=9A=E8=AD=B0?=",
+		"Subject: =?UTF-8?Q?=E6=98=A8=E6=97=A5=E3=81=AE=E4=BC=9A=E8=AD=B0?=\n" +
+			" =?UTF-8?Q?=E6=98=A8=E6=97=A5=E3=81=AE=E4=BC=9A=E8=AD=B0?="},
+	{"X-Long", "averyveryveryveryveryveryveryveryveryveryveryveryveryveryveryveryveryverylongword short",
+		"X-Long: averyveryveryveryveryveryveryveryveryveryveryveryveryveryveryveryveryverylongword\n" +
+			" short"},
+	{"Subject", strings.Repeat("x", 60) + " yyyyyyyy  ", "Subject: " + strings.Repeat("x", 60) + " yyyyyyyy  "},
+	{"Subject", strings.Repeat("x", 60) + " yyyyyyyy zzzzzz  ", "Subject: " + strings.Repeat("x", 60) + " yyyyyyyy\n zzzzzz  "},
+}
+
+func TestFoldHeader(t *testing.T) {
+	for _, data := range foldHeaderData {
+		if folded := foldHeader(data.name, data.value, "\n"); folded != data.folded {
+			t.Errorf("foldHeader(%#v, %#v) should be %#v, got %#v", data.name, data.value, data.folded, folded)
+		} else if !validHeaderValue(folded, "\n") {
+			t.Errorf("foldHeader(%#v, %#v) gives an invalid value %#v", data.name, data.value, folded)
+		}
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	for _, f := range []Field{
+		{"", "value"},
+		{"Bad Name", "value"},
+		{"Bad:Name", "value"},
+		{"Caf\xc3\xa9", "value"},
+		{"Subject", "Hello\r\nBcc: victim@example.com"},
+		{"Subject", "Hello\nBcc: victim@example.com"},
+		{"Subject", "Hello\rBcc: victim@example.com"},
+		{"Subject", "Hello\r\n \r\nInjected body"},
+		{"Subject", "Hello\r\n"},
+		{"Subject", "Hello\x00"},
+	} {
+		m := NewBinaryMessage(bytes.NewBufferString(""))
+		m.Headers.Add(f.Name, f.Value)
+		expected := InvalidHeaderValue
+		if f.Name != "Subject" {
+			expected = InvalidHeaderName
+		}
+		if _, err := io.ReadAll(m); err != expected {
+			t.Errorf("Field %#v should give %v, got %v", f, expected, err)
+		}
+	}
+
+	m := NewBinaryMessage(bytes.NewBufferString(""))
+	m.SetHeader("Subject", "Hello\r\n world")
+	if s := readAll(t, m); !strings.Contains(s, "\r\nSubject: Hello\r\n world\r\n") {
+		t.Errorf("Folded header should be kept, got %#v", s)
+	}
+}
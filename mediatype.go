@@ -0,0 +1,183 @@
+package message
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A media type, as used in the Content-Type header (RFC 2045), like
+// "text/plain; charset=UTF-8".
+type MediaType struct {
+	// Top-level type, like "text" or "image"
+	Type string
+
+	// Subtype, like "plain" or "png"
+	Subtype string
+
+	// Parameters, which are written in alphabetical order. Values are raw (unquoted,
+	// unencoded) UTF-8 strings.
+	Params map[string]string
+
+	// Language of the parameter values which are encoded according to RFC 2231 (like
+	// "fr" or "en-US"). Optional.
+	Lang string
+}
+
+// Maximum size of a parameter (or of a parameter continuation), so that it fits on its
+// own header line with the leading space and the trailing ";"
+const maxParamSize = maxHeaderLineSize - 2
+
+// Create a new media type without parameters.
+func NewMediaType(typ, subtype string) *MediaType {
+	return &MediaType{Type: typ, Subtype: subtype, Params: make(map[string]string)}
+}
+
+// Set a parameter, replacing any existing value.
+// Returns self.
+func (t *MediaType) SetParam(name, value string) *MediaType {
+	if t.Params == nil {
+		t.Params = make(map[string]string)
+	}
+	t.Params[name] = value
+	return t
+}
+
+// Format the media type for use in the Content-Type header. Parameter values are written
+// as tokens when possible, as quoted-strings otherwise. Non-ascii values are encoded
+// according to RFC 2231 (name*=UTF-8'lang'value), and values too long to fit on a line
+// are split into continuations (name*0, name*1, ...) so that the header can be folded.
+func (t *MediaType) String() string {
+	buf := bytes.NewBufferString(t.Type + "/" + t.Subtype)
+	names := make([]string, 0, len(t.Params))
+	for name := range t.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, param := range formatParam(name, t.Params[name], t.Lang) {
+			buf.WriteString("; ")
+			buf.WriteString(param)
+		}
+	}
+	return buf.String()
+}
+
+// Set the Content-Type header.
+// Returns self.
+func (m *Message) SetContentType(t *MediaType) *Message {
+	return m.SetHeader("Content-Type", t.String())
+}
+
+// Set the Content-Type header. The boundary parameter is added automatically, so t
+// should be a multipart/* media type without it.
+// Returns self.
+func (m *MultipartMessage) SetContentType(t *MediaType) *MultipartMessage {
+	params := make(map[string]string, len(t.Params)+1)
+	for name, value := range t.Params {
+		params[name] = value
+	}
+	params["boundary"] = m.Boundary
+	m.Message.SetContentType(&MediaType{t.Type, t.Subtype, params, t.Lang})
+	return m
+}
+
+func isTspecial(b byte) bool {
+	return strings.IndexByte("()<>@,;:\\\"/[]?=", b) != -1
+}
+
+// Returns true if s is a token (RFC 2045 section 5.1)
+func isToken(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] >= 0x7f || isTspecial(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Returns true if b can be written as is in an RFC 2231 extended value
+func isAttributeChar(b byte) bool {
+	return b > ' ' && b < 0x7f && !isTspecial(b) && b != '*' && b != '\'' && b != '%'
+}
+
+// Format a parameter, returning its continuations (a single element if the value is
+// short enough)
+func formatParam(name, value, lang string) []string {
+	ascii := true
+	for i := 0; i < len(value) && ascii; i++ {
+		ascii = value[i] >= ' ' && value[i] < 0x7f
+	}
+
+	if ascii {
+		if isToken(value) && len(name)+1+len(value) <= maxParamSize {
+			return []string{name + "=" + value}
+		}
+		if quoted := quoteString(value); len(name)+1+len(quoted) <= maxParamSize {
+			return []string{name + "=" + quoted}
+		}
+		return continueParam(name, "", "", value, func(r rune) string {
+			if r == '\\' || r == '"' {
+				return "\\" + string(r)
+			}
+			return string(r)
+		}, func(s string) string {
+			return "\"" + s + "\""
+		})
+	}
+
+	prefix := "UTF-8'" + lang + "'"
+	encode := func(r rune) string {
+		buf := bytes.NewBuffer(nil)
+		for _, b := range []byte(string(r)) {
+			if isAttributeChar(b) {
+				buf.WriteByte(b)
+			} else {
+				buf.Write([]byte{'%', hexTable[b>>4], hexTable[b&0xf]})
+			}
+		}
+		return buf.String()
+	}
+	whole := bytes.NewBuffer(nil)
+	for _, r := range value {
+		whole.WriteString(encode(r))
+	}
+	if len(name)+2+len(prefix)+whole.Len() <= maxParamSize {
+		return []string{name + "*=" + prefix + whole.String()}
+	}
+	return continueParam(name, "*", prefix, value, encode, nil)
+}
+
+// Split a parameter value into continuations (RFC 2231 section 3). Each rune is
+// converted with encode, and the resulting segments are wrapped with wrap (if not nil).
+// suffix is added after the continuation number ("*" for encoded values), and prefix
+// is added at the start of the first segment (the charset and language of encoded
+// values).
+func continueParam(name, suffix, prefix, value string, encode func(rune) string, wrap func(string) string) []string {
+	overhead := 0
+	if wrap != nil {
+		overhead = len(wrap(""))
+	}
+
+	var params []string
+	segment := bytes.NewBufferString(prefix)
+	flush := func() {
+		s := segment.String()
+		if wrap != nil {
+			s = wrap(s)
+		}
+		params = append(params, name+"*"+strconv.Itoa(len(params))+suffix+"="+s)
+		segment.Reset()
+	}
+	for _, r := range value {
+		e := encode(r)
+		head := len(name) + 1 + len(strconv.Itoa(len(params))) + len(suffix) + 1 + overhead
+		if segment.Len() > 0 && head+segment.Len()+len(e) > maxParamSize {
+			flush()
+		}
+		segment.WriteString(e)
+	}
+	flush()
+	return params
+}
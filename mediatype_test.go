@@ -0,0 +1,50 @@
+package message
+
+import (
+	"strings"
+	"testing"
+)
+
+var mediaTypeData = []struct {
+	mediaType *MediaType
+	formatted string
+}{
+	{NewMediaType("text", "plain"), "text/plain"},
+	{NewMediaType("text", "plain").SetParam("charset", "UTF-8").SetParam("format", "flowed"),
+		"text/plain; charset=UTF-8; format=flowed"},
+	{NewMediaType("multipart", "related").SetParam("type", "text/html"), "multipart/related; type=\"text/html\""},
+	{NewMediaType("application", "pdf").SetParam("name", "my \"report\".pdf"),
+		"application/pdf; name=\"my \\\"report\\\".pdf\""},
+	{NewMediaType("application", "pdf").SetParam("name", "résumé.pdf"),
+		"application/pdf; name*=UTF-8''r%C3%A9sum%C3%A9.pdf"},
+	{&MediaType{"application", "pdf", map[string]string{"name": "café"}, "fr"},
+		"application/pdf; name*=UTF-8'fr'caf%C3%A9"},
+	{NewMediaType("application", "pdf").SetParam("name", strings.Repeat("abcdefghij", 10)),
+		"application/pdf; name*0=\"" + strings.Repeat("abcdefghij", 6) + "abcdefg\"; name*1=\"" +
+			"hij" + strings.Repeat("abcdefghij", 3) + "\""},
+	{NewMediaType("application", "pdf").SetParam("name", strings.Repeat("é", 20)),
+		"application/pdf; name*0*=UTF-8''" + strings.Repeat("%C3%A9", 10) + "; name*1*=" +
+			strings.Repeat("%C3%A9", 10)},
+}
+
+func TestMediaType(t *testing.T) {
+	for _, data := range mediaTypeData {
+		if formatted := data.mediaType.String(); formatted != data.formatted {
+			t.Errorf("Media type should be formatted as %#v, got %#v", data.formatted, formatted)
+		}
+	}
+}
+
+func TestMediaTypeFolding(t *testing.T) {
+	m := NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+	m.SetContentType(NewMediaType("multipart", "mixed").SetParam("title", strings.Repeat("日本語", 20)))
+	expected := "multipart/mixed; boundary=\"==GoMultipartBoundary:0.\"; title*0*=UTF-8''"
+	if ct := m.Headers.Get("Content-Type"); !strings.HasPrefix(ct, expected) {
+		t.Errorf("Content-Type %#v should start with %#v", ct, expected)
+	}
+	for _, line := range strings.Split(readAll(t, m), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Line %#v is longer than 78 characters", line)
+		}
+	}
+}
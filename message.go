@@ -3,11 +3,19 @@
 package message
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"github.com/sloonz/go-qprintable"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 	"io"
-	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type Message struct {
@@ -17,8 +25,10 @@ type Message struct {
 	//  - you should not use "binary" and "8bit", since such messages will not
 	//    be conform with SMTP
 	//  - for encodings other than base64 and quoted-printable, it is your responsibility
-	//    to ensure that the given data conforms to the encoding, and that data does not
-	//    contain the multipart boundary in multipart parts
+	//    to ensure that data does not contain the multipart boundary in multipart parts.
+	//    For 7bit and 8bit, Read also checks that data conforms to the encoding (no NUL,
+	//    no bare CR or LF, lines of at most 998 octets, no 8-bit data for 7bit) and
+	//    fails with a BodyError if it doesn't ; see UpgradeTE
 	// If you use NewTextMessage, NewBinaryMessage and NewMultipartMessage, you shouldn't
 	// have to worry about this. It is wise not to modify it yourself, since defautlts
 	// are standard compliants and works well with multipart messages
@@ -30,10 +40,9 @@ type Message struct {
 	// (in practice, few MUA are perturbated by bad end of lines)
 	QPEncoding *qprintable.Encoding
 
-	// Headers of the message. They are stored in the http.CanonicalHeaderKey format.
-	// Don't put content-transfer-encoding nor mime-version into this, it will be handled
-	// internally.
-	Headers map[string]string
+	// Headers of the message, written in order. Don't put content-transfer-encoding nor
+	// mime-version into this, it will be handled internally.
+	Headers Header
 
 	// End of line characters. Defaults to CRLF (as required by most standards), but you may
 	// want change this to "\n" if you intend to write in a Maildir, which requires LF line
@@ -43,9 +52,64 @@ type Message struct {
 	// The body of the message
 	Body io.Reader
 
-	isMultipartPart bool
-	buf             *bytes.Buffer
-	bodyReader      io.Reader
+	// If set, called each time the message is read (see Reset) to get its body, instead
+	// of using Body.
+	BodyFunc func() (io.Reader, error)
+
+	// Build the message for a server supporting SMTPUTF8 (RFC 6531): headers set with
+	// SetTextHeader, SetFrom, SetTo, ... are written in UTF-8 (RFC 6532) instead of using
+	// encoded-words and Punycode domains, and Read fails if an header is not valid UTF-8.
+	// Addresses whose local part is not ascii can only be written in this mode. Since
+	// SMTPUTF8 implies 8BITMIME, parts may also use the 8bit transfer encoding.
+	//
+	// Headers set with these functions are formatted when the message is written, so it
+	// may be set afterwards. Parts of a multipart message inherit it from the multipart
+	// message ; it can't be unset for a part.
+	UTF8Headers bool
+
+	// If true, a 7bit or 8bit body which doesn't conform to its transfer encoding is
+	// encoded with quoted-printable instead of making Read fail. Since the body has to be
+	// checked before writing the header, it's read twice: if it's not an io.Seeker and
+	// BodyFunc is not set, it's kept in memory. QPEncoding is then set to the text
+	// encoding matching the line breaks of the body. Since message/* and multipart/*
+	// entities can't use quoted-printable, they are only switched from 7bit to 8bit if
+	// they contain 8-bit data. This does not apply to multipart and embedded messages
+	// created with NewMultipartMessage and NewEmbeddedMessage.
+	UpgradeTE bool
+
+	// If true, Read adds the Date and Message-ID headers when they are missing. This
+	// only applies to top-level messages, not to parts of a multipart message. The
+	// generated headers are stored in Headers.
+	AutoHeaders bool
+
+	// Clock used to fill the Date header. Defaults to time.Now.
+	Now func() time.Time
+
+	// Domain used in generated Message-IDs (the part after the "@"). Defaults to the
+	// host name, or "localhost" if it can't be used.
+	MessageIDDomain string
+
+	isMultipartPart      bool
+	err                  error // error while building the message, returned by Read
+	buf                  *bytes.Buffer
+	bodyReader           io.Reader
+	lineBreak            string            // line break of the canonical form of a 7bit or base64 text body, see eolReader
+	seekable             bool              // true if the position of Body at the first read is known
+	bodyStart            int64             // position of Body at the first read
+	transcoder           encoding.Encoding // charset the body is transcoded to, if not UTF-8
+	bodySize             int64             // length of the body, see SetBodySize
+	bodySizeKnown        bool
+	path                 string // path of the part in the message, see BodyError
+	lazyHeaders          map[string]*lazyHeader
+	inheritedUTF8Headers bool // UTF8Headers is set on the multipart message containing this part
+}
+
+// An header whose value depends on UTF8Headers, and is thus formatted when the message
+// is written (see SetAddresses)
+type lazyHeader struct {
+	value  string // value stored in Headers ; if it was changed since, it's written as is
+	format func(utf8Headers bool) (string, error)
+	addrs  []*Address // addresses of the header, if they can be appended to
 }
 
 // New message containing text data. It will be encoded with quoted-printable encoding.
@@ -55,67 +119,370 @@ func NewTextMessage(qpEncoding *qprintable.Encoding, body io.Reader) *Message {
 	m.TE = TE_qprintable
 	m.QPEncoding = qpEncoding
 	m.Body = body
-	m.Headers = make(map[string]string)
 	m.EOL = "\r\n"
 	return m
 }
 
+// New message containing text data, transcoded from UTF-8 to the given charset (for
+// example "ISO-2022-JP"). It will be encoded with quoted-printable encoding. The
+// Content-Type header is set to text/plain with the charset parameter ; if you need
+// another text/* media type, don't forget to keep the charset parameter.
+// Characters that can't be represented in the charset make Read fail.
+func NewTextMessageCharset(qpEncoding *qprintable.Encoding, charset string, body io.Reader) (*Message, error) {
+	m := NewTextMessage(qpEncoding, body)
+	if !isUTF8Charset(charset) {
+		enc, err := lookupCharset(charset)
+		if err != nil {
+			return nil, err
+		}
+		m.transcoder = enc
+	}
+	m.SetContentType(NewMediaType("text", "plain").SetParam("charset", charset))
+	return m, nil
+}
+
 // New message containing binary data. It will be encoded with base64 encoding.
 // You should use this for all media types but text/* and multipart/*
 func NewBinaryMessage(body io.Reader) *Message {
 	m := new(Message)
 	m.TE = TE_base64
 	m.Body = body
-	m.Headers = make(map[string]string)
 	m.EOL = "\r\n"
 	return m
 }
 
-// Set an header. val will be directly written ; to escape it, see EncodeWord.
+// New message whose transfer encoding is chosen from its content: 7bit for ascii text
+// with lines shorter than 998 characters, quoted-printable for text with a few
+// non-ascii characters or longer lines, and base64 for binary data (containing NUL
+// bytes, or with so many bytes to escape that quoted-printable would be bigger).
+//
+// qpEncoding is the canonical form of the body (see QPEncoding): use a text encoding for
+// text/* media types, and BinaryEncoding otherwise. Like with quoted-printable, line
+// breaks of the canonical form are converted to EOL when 7bit is chosen, and to CRLF
+// when base64 is chosen for text.
+//
+// The whole body is scanned first. If it's an io.Seeker, it's then rewound to its
+// current position ; otherwise, it's kept in memory (so that the message can always be
+// read again, see Reset).
+func NewAutoMessage(qpEncoding *qprintable.Encoding, body io.Reader) (*Message, error) {
+	scanner := &bodyScanner{lineBreak: qpLineBreak(qpEncoding)}
+	if seeker, ok := body.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(scanner, body); err != nil {
+			return nil, err
+		}
+		if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+	} else {
+		buf := bytes.NewBuffer(nil)
+		if _, err := io.Copy(io.MultiWriter(scanner, buf), body); err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(buf.Bytes())
+	}
+
+	switch scanner.transferEncoding() {
+	case TE_base64:
+		m := NewBinaryMessage(body)
+		if scanner.lineBreak != "\r\n" {
+			// Text is encoded in its canonical form, with CRLF line breaks (RFC 2045
+			// section 6.8)
+			m.lineBreak = scanner.lineBreak
+		}
+		return m, nil
+	case TE_qprintable:
+		return NewTextMessage(qpEncoding, body), nil
+	}
+	m := NewTextMessage(qpEncoding, body)
+	m.TE = TE_7bit
+	m.lineBreak = scanner.lineBreak
+	return m, nil
+}
+
+// New message embedding another message (for example, a forwarded mail or a bounce).
+// Its Content-Type is message/rfc822, or message/global (RFC 6532) if the embedded
+// message has UTF8Headers set ; in the latter case, the 8bit transfer encoding is used,
+// and the enclosing message must have UTF8Headers set too. EOL for the embedded message
+// will be inherited from this message.
+func NewEmbeddedMessage(msg *Message) *Message {
+	m := new(Message)
+	m.TE = TE_7bit
+	m.Body = msg
+	m.EOL = "\r\n"
+	if msg.UTF8Headers {
+		m.TE = TE_8bit
+		m.SetHeader("Content-Type", "message/global")
+	} else {
+		m.SetHeader("Content-Type", "message/rfc822")
+	}
+	return m
+}
+
+// Set an header, replacing any existing value (see Header.Set). val will be directly
+// written ; to escape it, see EncodeWord.
 // Returns self.
 func (m *Message) SetHeader(name, val string) *Message {
-	m.Headers[http.CanonicalHeaderKey(name)] = val
+	m.Headers.Set(name, val)
 	return m
 }
 
-// Read the MIME representation of the message (headers + body). You can do this
-// only once, since after the first representation this will always return os.EOF.
-// For base64 and quoted-printable encodings, also take care of encoding the body.
-func (m *Message) Read(p []byte) (n int, err error) {
-	// Write message header to buffer on first call
-	// TODO: wrap headers ?
-	if m.buf == nil {
-		m.buf = bytes.NewBuffer(nil)
-		if !m.isMultipartPart {
-			m.buf.WriteString("MIME-Version: 1.0" + m.EOL)
-		}
-		if m.TE != TE_7bit {
-			if (m.TE == TE_8bit || m.TE == TE_binary) && m.isMultipartPart {
-				return n, PartInvalidTransferEncoding
-			} else {
-				m.buf.WriteString("Content-Transfer-Encoding: " + string(m.TE) + m.EOL)
+// Set an header formatted when the message is written. Headers gets the value formatted
+// according to the current UTF8Headers if possible, in UTF-8 otherwise.
+func (m *Message) setLazyHeader(name string, addrs []*Address, format func(bool) (string, error)) {
+	val, err := format(m.utf8Headers())
+	if err != nil {
+		val, _ = format(true)
+	}
+	if m.lazyHeaders == nil {
+		m.lazyHeaders = make(map[string]*lazyHeader)
+	}
+	m.lazyHeaders[strings.ToLower(name)] = &lazyHeader{val, format, addrs}
+	m.Headers.Set(name, val)
+}
+
+// Returns the lazy header with the given name, or nil if there is none or if its value
+// was changed in Headers
+func (m *Message) lazyHeader(name string) *lazyHeader {
+	h := m.lazyHeaders[strings.ToLower(name)]
+	if h == nil || h.value != m.Headers.Get(name) {
+		return nil
+	}
+	return h
+}
+
+// Set an unstructured header (like Subject), replacing any existing value. val is
+// encoded with EncodeText when the message is written, unless UTF8Headers is set.
+// Returns self.
+func (m *Message) SetTextHeader(name, val string) *Message {
+	m.setLazyHeader(name, nil, func(utf8Headers bool) (string, error) {
+		return (&WordEncoder{UTF8: utf8Headers}).EncodeText(val), nil
+	})
+	return m
+}
+
+// Returns true if headers are written in UTF-8, because UTF8Headers is set on the
+// message or on the multipart message containing it
+func (m *Message) utf8Headers() bool {
+	return m.UTF8Headers || m.inheritedUTF8Headers
+}
+
+// Format a date as required by RFC 5322 for the Date header (for example
+// "Mon, 02 Jan 2006 15:04:05 -0700").
+func FormatDate(t time.Time) string {
+	return t.Format(time.RFC1123Z)
+}
+
+// Generate a new globally unique Message-ID (including the angle brackets) from 128
+// random bits and the given domain, like "<3f2a...c1d9@example.com>".
+func NewMessageID(domain string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "<" + hex.EncodeToString(id) + "@" + domain + ">", nil
+}
+
+// Add the Date and Message-ID headers if they are missing
+func (m *Message) addAutoHeaders() error {
+	if m.Headers.Get("Date") == "" {
+		now := m.Now
+		if now == nil {
+			now = time.Now
+		}
+		m.Headers.Add("Date", FormatDate(now()))
+	}
+	if m.Headers.Get("Message-ID") == "" {
+		domain := m.MessageIDDomain
+		if domain == "" {
+			var err error
+			if domain, err = os.Hostname(); err != nil || !isDotAtom(domain, false) {
+				domain = "localhost"
+			}
+		}
+		id, err := NewMessageID(domain)
+		if err != nil {
+			return err
+		}
+		m.Headers.Add("Message-ID", id)
+	}
+	return nil
+}
+
+// Write the header of the message, including the empty line separating it from the body
+func (m *Message) writeHeader(buf *bytes.Buffer) error {
+	if !m.isMultipartPart {
+		if m.AutoHeaders {
+			if err := m.addAutoHeaders(); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("MIME-Version: 1.0" + m.EOL)
+	}
+	if m.TE != TE_7bit {
+		if (m.TE == TE_binary || (m.TE == TE_8bit && !m.utf8Headers())) && m.isMultipartPart {
+			return PartInvalidTransferEncoding
+		}
+		buf.WriteString("Content-Transfer-Encoding: " + string(m.TE) + m.EOL)
+	}
+	for _, f := range m.Headers.fields {
+		if h := m.lazyHeaders[strings.ToLower(f.Name)]; h != nil && h.value == f.Value {
+			val, err := h.format(m.utf8Headers())
+			if err != nil {
+				return &HeaderError{f.Name, err}
 			}
+			f.Value = val
 		}
-		for name, val := range m.Headers {
-			m.buf.WriteString(name + ": " + val + m.EOL)
+		if err := validateField(f, m.EOL); err != nil {
+			return err
 		}
-		m.buf.WriteString(m.EOL)
+		if m.utf8Headers() && !utf8.ValidString(f.Value) {
+			return InvalidUTF8Header
+		}
+		buf.WriteString(foldHeader(f.Name, f.Value, m.EOL) + m.EOL)
 	}
+	buf.WriteString(m.EOL)
+	return nil
+}
 
-	// Create body transform (transfer encoding)
-	if m.bodyReader == nil {
+// Returns the body to encode: the result of BodyFunc if set, Body otherwise, transcoded
+// if needed
+func (m *Message) openBody() (io.Reader, error) {
+	body := m.Body
+	if m.BodyFunc != nil {
+		var err error
+		if body, err = m.BodyFunc(); err != nil {
+			return nil, err
+		}
+	} else if seeker, ok := body.(io.Seeker); ok && !m.seekable {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		m.bodyStart, m.seekable = start, true
+	}
+	if m.transcoder != nil {
+		body = transform.NewReader(body, m.transcoder.NewEncoder())
+	}
+	if m.TE == TE_base64 && m.lineBreak != "" {
+		body = &eolReader{"\r\n", m.lineBreak, bufio.NewReader(body), bytes.NewBuffer(nil)}
+	}
+	if embedded, ok := body.(*Message); ok {
+		embedded.EOL = m.EOL
+	}
+	return body, nil
+}
+
+// Create the reader giving the encoded body (transfer encoding)
+func (m *Message) newBodyReader() (io.Reader, error) {
+	body, err := m.openBody()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if m.TE == TE_qprintable {
+		return &qprintableReader{body, buf, qprintable.NewEncoderWithEOL(m.EOL, m.QPEncoding, buf)}, nil
+	} else if m.TE == TE_base64 {
+		return &base64Reader{[]byte(m.EOL), body, buf, base64.NewEncoder(base64.StdEncoding, buf), 0, nil}, nil
+	}
+	return m.plainBodyReader(body), nil
+}
+
+// Write the encoded body directly to w
+func (m *Message) writeBody(w io.Writer, body io.Reader) (err error) {
+	if r, ok := body.(*multipartReader); ok {
+		return r.writeTo(w)
+	}
+
+	if m.TE == TE_qprintable {
+		_, err = io.Copy(qprintable.NewEncoderWithEOL(m.EOL, m.QPEncoding, w), body)
+	} else if m.TE == TE_base64 {
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w, []byte(m.EOL), 0})
+		if _, err = io.Copy(encoder, body); err == nil {
+			err = encoder.Close()
+		}
+	} else {
+		_, err = io.Copy(w, m.plainBodyReader(body))
+	}
+	return err
+}
+
+// Write the MIME representation of the message to w. The result is the same as with
+// Read, but headers and encoded body are written to w through a single buffer instead of
+// going through intermediate buffers for each part. This implements io.WriterTo, so
+// io.Copy uses it.
+// Like with Read, the message must be reset before being written again.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	// Encoders write line by line, so avoid small writes to w (a net.Conn for example)
+	cw := &countingWriter{w, 0}
+	bw := bufio.NewWriter(cw)
+	err := m.writeTo(bw)
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	return cw.n, err
+}
+
+// Write the message to w without buffering, see WriteTo
+func (m *Message) writeTo(w io.Writer) error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.buf != nil {
+		// Already (partially) read, write what remains
+		_, err := io.Copy(w, struct{ io.Reader }{m})
+		return err
+	}
+
+	if err := m.upgradeTE(); err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := m.writeHeader(buf); err != nil {
+		return err
+	}
+	body, err := m.openBody()
+	if err != nil {
+		return err
+	}
+	m.buf, m.bodyReader = bytes.NewBuffer(nil), bytes.NewReader(nil)
+
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return m.writeBody(w, body)
+}
+
+// Read the MIME representation of the message (headers + body). For base64 and
+// quoted-printable encodings, also take care of encoding the body. Once the whole
+// representation has been read, this will always return io.EOF ; use Reset to read it
+// again.
+func (m *Message) Read(p []byte) (n int, err error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	// Write message header to buffer on first call
+	if m.buf == nil {
+		if err = m.upgradeTE(); err != nil {
+			return 0, err
+		}
 		buf := bytes.NewBuffer(nil)
-		if m.TE == TE_qprintable {
-			m.bodyReader = &qprintableReader{m.Body, buf, qprintable.NewEncoderWithEOL(m.EOL, m.QPEncoding, buf)}
-		} else if m.TE == TE_base64 {
-			m.bodyReader = &base64Reader{[]byte(m.EOL), m.Body, buf, base64.NewEncoder(base64.StdEncoding, buf), 0, nil}
-		} else {
-			m.bodyReader = m.Body
+		if err = m.writeHeader(buf); err != nil {
+			return 0, err
 		}
+		if m.bodyReader, err = m.newBodyReader(); err != nil {
+			return 0, err
+		}
+		m.buf = buf
 	}
 
 	// Main loop
-	for len(p) > n && err != io.EOF {
+	for len(p) > n && err == nil {
 		if m.buf.Len() > 0 {
 			nn, _ := m.buf.Read(p[n:])
 			n += nn
@@ -128,3 +495,35 @@ func (m *Message) Read(p []byte) (n int, err error) {
 
 	return n, err
 }
+
+// Prepare the message to be read again from the beginning. This requires the body to
+// be rewindable: Body must be an io.Seeker (like bytes.Reader, strings.Reader or
+// os.File, which are rewound to their position at the beginning of the first read),
+// or BodyFunc must be set. Multipart messages are rewindable if all their parts are.
+// Otherwise, NotRewindable is returned.
+func (m *Message) Reset() error {
+	if m.buf == nil {
+		return nil
+	}
+	if m.BodyFunc == nil {
+		switch body := m.Body.(type) {
+		case *multipartReader:
+			if err := body.reset(); err != nil {
+				return err
+			}
+		case *Message:
+			if err := body.Reset(); err != nil {
+				return err
+			}
+		case io.Seeker:
+			if _, err := body.Seek(m.bodyStart, io.SeekStart); err != nil {
+				return err
+			}
+		default:
+			return NotRewindable
+		}
+	}
+	m.buf = nil
+	m.bodyReader = nil
+	return nil
+}
@@ -5,9 +5,11 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/sloonz/go-qprintable"
+	"io"
 	"net/textproto"
 	"strings"
 	"testing"
+	"time"
 )
 
 const MESSAGE = "Lorem ipsum dolor sit amet, consectetur adipiscing " +
@@ -180,3 +182,324 @@ func TestMultipartRelated(t *testing.T) {
 		t.Errorf("Content-Type is %s, expected %s", actualType, expectedType)
 	}
 }
+
+func TestTextMessageCharset(t *testing.T) {
+	m, err := NewTextMessageCharset(qprintable.UnixTextEncoding, "ISO-8859-1", bytes.NewBufferString("Café\n"))
+	if err != nil {
+		t.Fatalf("Can't create message: %v", err)
+	}
+	expected := "MIME-Version: 1.0\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+		"\r\n" +
+		"Caf=E9\r\n"
+	buf := bytes.NewBuffer(nil)
+	if _, err = buf.ReadFrom(m); err != nil {
+		t.Fatalf("Can't read message: %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Message is %#v, expected %#v", buf.String(), expected)
+	}
+
+	m, err = NewTextMessageCharset(qprintable.UnixTextEncoding, "US-ASCII", bytes.NewBufferString("Café\n"))
+	if err != nil {
+		t.Fatalf("Can't create message: %v", err)
+	}
+	if _, err = io.ReadAll(m); err == nil {
+		t.Errorf("Non-ascii characters should make Read fail for US-ASCII")
+	}
+
+	if _, err = NewTextMessageCharset(qprintable.UnixTextEncoding, "X-UNKNOWN", nil); err != UnsupportedCharset {
+		t.Errorf("Expected UnsupportedCharset error, got %v", err)
+	}
+}
+
+func TestUTF8Headers(t *testing.T) {
+	part := NewTextMessage(qprintable.UnixTextEncoding, bytes.NewBufferString("Bonjour\n"))
+	part.SetTextHeader("Content-Description", "Pièce jointe")
+	inner := NewBinaryMessage(bytes.NewBufferString(""))
+	inner.UTF8Headers = true
+	inner.SetTextHeader("Subject", "Réunion")
+	m := NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+	m.UTF8Headers = true
+	m.SetTextHeader("Subject", "Réunion à 10h")
+	m.AddPart(part).AddPart(NewEmbeddedMessage(inner))
+
+	s := readAll(t, m)
+	for _, expected := range []string{
+		"\r\nSubject: Réunion à 10h\r\n",
+		"\r\nContent-Description: Pièce jointe\r\n",
+		"\r\nContent-Transfer-Encoding: 8bit\r\nContent-Type: message/global\r\n\r\nMIME-Version: 1.0\r\n",
+		"\r\nSubject: Réunion\r\n",
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("Message %#v should contain %#v", s, expected)
+		}
+	}
+
+	// A part keeps its own setting
+	part = NewBinaryMessage(bytes.NewBufferString(""))
+	part.UTF8Headers = true
+	part.SetTextHeader("Subject", "Réunion")
+	m = NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+	m.AddPart(part)
+	if s := readAll(t, m); !strings.Contains(s, "\r\nSubject: Réunion\r\n") || !part.UTF8Headers {
+		t.Errorf("Part should be written with UTF-8 headers, got %#v", s)
+	}
+
+	m = NewMultipartMessage("mixed", "")
+	m.AddPart(NewEmbeddedMessage(inner))
+	if _, err := io.ReadAll(m); err != PartInvalidTransferEncoding {
+		t.Errorf("message/global parts should require UTF8Headers, got %v", err)
+	}
+
+	m = NewMultipartMessage("mixed", "")
+	m.UTF8Headers = true
+	m.AddPart(NewBinaryMessage(bytes.NewBufferString("")).SetHeader("Subject", "\xff"))
+	if _, err := io.ReadAll(m); err != InvalidUTF8Header {
+		t.Errorf("Expected InvalidUTF8Header error, got %v", err)
+	}
+}
+
+func TestAutoHeaders(t *testing.T) {
+	part := NewBinaryMessage(bytes.NewBufferString(""))
+	m := NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+	m.AutoHeaders = true
+	m.Now = func() time.Time { return time.Date(2014, 3, 7, 9, 5, 0, 0, time.FixedZone("", 3600)) }
+	m.MessageIDDomain = "example.com"
+	m.AddPart(part)
+
+	s := readAll(t, m)
+	if !strings.Contains(s, "\r\nDate: Fri, 07 Mar 2014 09:05:00 +0100\r\n") {
+		t.Errorf("Message %#v should contain the Date header", s)
+	}
+	id := m.Headers.Get("Message-ID")
+	if len(id) != len("<@example.com>")+32 || !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Invalid Message-ID %#v", id)
+	}
+	if !strings.Contains(s, "\r\nMessage-ID: "+id+"\r\n") {
+		t.Errorf("Message %#v should contain the Message-ID header", s)
+	}
+	if part.Headers.Len() != 0 {
+		t.Errorf("Parts should not get automatic headers, got %#v", part.Headers.Fields())
+	}
+
+	other, err := NewMessageID("example.com")
+	if err != nil || other == id {
+		t.Errorf("NewMessageID should generate unique identifiers, got %#v (%v)", other, err)
+	}
+
+	m2 := NewBinaryMessage(bytes.NewBufferString(""))
+	m2.AutoHeaders = true
+	m2.SetHeader("Date", "Thu, 01 Jan 1970 00:00:00 +0000")
+	m2.SetHeader("Message-ID", "<fixed@example.com>")
+	readAll(t, m2)
+	if m2.Headers.Len() != 2 || m2.Headers.Get("Date") != "Thu, 01 Jan 1970 00:00:00 +0000" {
+		t.Errorf("Existing headers should be kept, got %#v", m2.Headers.Fields())
+	}
+}
+
+var autoMessageData = []struct {
+	qpEncoding *qprintable.Encoding
+	body       string
+	te         TransferEncoding
+	encoded    string
+}{
+	{qprintable.UnixTextEncoding, "Hello,\nworld\n", TE_7bit, "Hello,\r\nworld\r\n"},
+	{qprintable.WindowsTextEncoding, "Hello,\r\nworld\r\n", TE_7bit, "Hello,\r\nworld\r\n"},
+	{qprintable.UnixTextEncoding, "Hello\rworld\n", TE_qprintable, "Hello=0Dworld\r\n"},
+	{qprintable.UnixTextEncoding, "Un café, s'il vous plaît.\n", TE_qprintable, "Un caf=C3=A9, s'il vous pla=C3=AEt.\r\n"},
+	{qprintable.UnixTextEncoding, strings.Repeat("a", 1000), TE_qprintable, ""},
+	{qprintable.UnixTextEncoding, "昨日の会議", TE_base64, "5pio5pel44Gu5Lya6K2w"},
+	{qprintable.UnixTextEncoding, "日本語\n日本語\n", TE_base64, "5pel5pys6KqeDQrml6XmnKzoqp4NCg=="},
+	{qprintable.BinaryEncoding, "abc\x00def", TE_base64, "YWJjAGRlZg=="},
+	{qprintable.BinaryEncoding, "abc\ndef", TE_qprintable, "abc=0Adef"},
+}
+
+func TestAutoMessage(t *testing.T) {
+	for _, data := range autoMessageData {
+		for _, body := range []io.Reader{bytes.NewBufferString(data.body), strings.NewReader(data.body)} {
+			m, err := NewAutoMessage(data.qpEncoding, body)
+			if err != nil {
+				t.Fatalf("Can't create message: %v", err)
+			}
+			if m.TE != data.te {
+				t.Errorf("Transfer encoding of %#v should be %v, got %v", data.body, data.te, m.TE)
+				continue
+			}
+			s := readAll(t, m)
+			body := s[strings.Index(s, "\r\n\r\n")+4:]
+			if data.encoded != "" && body != data.encoded {
+				t.Errorf("Body of %#v should be %#v, got %#v", data.body, data.encoded, body)
+			}
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	calls := 0
+	html := NewTextMessage(qprintable.UnixTextEncoding, nil)
+	html.BodyFunc = func() (io.Reader, error) {
+		calls++
+		return bytes.NewBufferString("<p>Café</p>\n"), nil
+	}
+	latin1, err := NewTextMessageCharset(qprintable.UnixTextEncoding, "ISO-8859-1", strings.NewReader("Café\n"))
+	if err != nil {
+		t.Fatalf("Can't create message: %v", err)
+	}
+	alternative := NewMultipartMessage("alternative", "==GoMultipartBoundary:1.")
+	alternative.AddPart(latin1).AddPart(html)
+	m := NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+	m.AddPart(&alternative.Message)
+	m.Attach(&Attachment{Filename: "image"}, strings.NewReader("\x89PNG\r\n\x1a\n"))
+
+	first := readAll(t, m)
+	if err := m.Reset(); err != nil {
+		t.Fatalf("Can't reset message: %v", err)
+	}
+	if second := readAll(t, m); second != first {
+		t.Errorf("Second representation %#v differs from the first one %#v", second, first)
+	}
+	if calls != 2 {
+		t.Errorf("BodyFunc should have been called twice, got %d calls", calls)
+	}
+
+	m.AddPart(NewBinaryMessage(bytes.NewBufferString("data")))
+	readAll(t, m)
+	if err := m.Reset(); err != NotRewindable {
+		t.Errorf("Expected NotRewindable error, got %v", err)
+	}
+}
+
+// Build a message using most features, with rewindable bodies
+func newComplexMessage(binarySize int) *MultipartMessage {
+	text := NewTextMessage(qprintable.UnixTextEncoding, strings.NewReader(strings.Repeat(MESSAGE+" Café.\n", 20)))
+	text.SetHeader("Content-Type", "text/plain; charset=UTF-8")
+	latin1, _ := NewTextMessageCharset(qprintable.UnixTextEncoding, "ISO-8859-1", strings.NewReader("Café\n"))
+	plain, _ := NewAutoMessage(qprintable.UnixTextEncoding, strings.NewReader("Hello\nworld\n"))
+	alternative := NewMultipartMessage("alternative", "==GoMultipartBoundary:1.")
+	alternative.AddPart(text).AddPart(latin1).AddPart(plain)
+
+	inner := NewBinaryMessage(bytes.NewReader(make([]byte, 57)))
+	inner.SetTextHeader("Subject", "Réunion")
+
+	m := NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+	m.SetTextHeader("Subject", "Réunion à 10h")
+	m.SetFrom(NewAddress("Müller", "mueller@bücher.example"))
+	m.AddPart(&alternative.Message)
+	m.AddPart(NewEmbeddedMessage(inner))
+	for _, size := range []int{0, 56, 58, binarySize} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		m.Attach(&Attachment{Filename: "data.bin"}, bytes.NewReader(data))
+	}
+	return m
+}
+
+func TestWriteTo(t *testing.T) {
+	for _, eol := range []string{"\r\n", "\n"} {
+		m := newComplexMessage(1000)
+		m.EOL = eol
+		expected := readAll(t, m)
+		if err := m.Reset(); err != nil {
+			t.Fatalf("Can't reset message: %v", err)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		n, err := m.WriteTo(buf)
+		if err != nil {
+			t.Fatalf("Can't write message: %v", err)
+		}
+		if buf.String() != expected || n != int64(len(expected)) {
+			t.Errorf("WriteTo gives %#v (%d bytes), expected %#v", buf.String(), n, expected)
+		}
+		if n, err := m.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+			t.Errorf("Message should be consumed after WriteTo")
+		}
+
+		// Output should be written in chunks of the bufio.Writer size
+		m.Reset()
+		w := new(callCounter)
+		if _, err = m.WriteTo(w); err != nil {
+			t.Fatalf("Can't write message: %v", err)
+		}
+		if max := len(expected)/4096 + 1; w.calls > max {
+			t.Errorf("WriteTo made %d calls to Write, expected at most %d", w.calls, max)
+		}
+	}
+}
+
+func benchmarkRender(b *testing.B, render func(m *Message) error) {
+	m := newComplexMessage(1 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := render(&m.Message); err != nil {
+			b.Fatal(err)
+		}
+		if err := m.Reset(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkRender(b, func(m *Message) error {
+		// Hide WriteTo so that io.Copy uses Read
+		_, err := io.Copy(io.Discard, struct{ io.Reader }{m})
+		return err
+	})
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	benchmarkRender(b, func(m *Message) error {
+		_, err := m.WriteTo(io.Discard)
+		return err
+	})
+}
+
+// Sink counting the calls to Write, which are syscalls for a net.Conn
+type callCounter struct {
+	calls int
+}
+
+func (w *callCounter) Write(p []byte) (int, error) {
+	w.calls++
+	return len(p), nil
+}
+
+func BenchmarkWriteToCalls(b *testing.B) {
+	w := new(callCounter)
+	benchmarkRender(b, func(m *Message) error {
+		_, err := m.WriteTo(w)
+		return err
+	})
+	b.ReportMetric(float64(w.calls)/float64(b.N), "writes/op")
+}
+
+func TestSize(t *testing.T) {
+	for _, eol := range []string{"\r\n", "\n"} {
+		m := newComplexMessage(1000)
+		m.EOL = eol
+		m.AutoHeaders = true
+		size, err := m.Size()
+		if err != nil {
+			t.Fatalf("Can't compute size: %v", err)
+		}
+		if s := readAll(t, m); int64(len(s)) != size {
+			t.Errorf("Size is %d, expected %d", size, len(s))
+		}
+	}
+
+	for _, n := range []int{0, 1, 56, 57, 58, 113, 114, 115} {
+		m := NewBinaryMessage(struct{ io.Reader }{bytes.NewReader(make([]byte, n))})
+		if _, err := m.Size(); err != UnknownSize {
+			t.Errorf("Expected UnknownSize error, got %v", err)
+		}
+		size, err := m.SetBodySize(int64(n)).Size()
+		if s := readAll(t, m); err != nil || int64(len(s)) != size {
+			t.Errorf("Size of a %d bytes body is %d (%v), expected %d", n, size, err, len(s))
+		}
+	}
+}
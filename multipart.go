@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
 )
 
@@ -34,7 +35,8 @@ func NewMultipartMessage(subtype, boundary string) *MultipartMessage {
 //
 // Additional parameters (e.g. type for multipart/related) can be supplied.
 // It is the responsibility of the caller to encode them
-// (atom / quoted-string according to RFC 2822)
+// (atom / quoted-string according to RFC 2822) ; see MultipartMessage.SetContentType
+// to have them encoded automatically.
 //
 // You should not modify Body field of the returned structure.
 func NewMultipartMessageParams(subtype, boundary string, params map[string]string) *MultipartMessage {
@@ -57,25 +59,34 @@ func NewMultipartMessageParams(subtype, boundary string, params map[string]strin
 	ctBuf.WriteString(boundary)
 	ctBuf.WriteString("\"")
 
-	for k, v := range params {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
 		ctBuf.WriteString("; ")
 		ctBuf.WriteString(k)
 		ctBuf.WriteByte('=')
-		ctBuf.WriteString(v)
+		ctBuf.WriteString(params[k])
 	}
 
+	m := newMultipartMessage(boundary)
+	m.SetHeader("Content-Type", ctBuf.String())
+	return m
+}
+
+func newMultipartMessage(boundary string) *MultipartMessage {
 	m := new(MultipartMessage)
 	m.TE = TE_7bit
-	m.Headers = make(map[string]string)
 	m.Body = &multipartReader{m, -1, bytes.NewBuffer(nil)}
-	m.SetHeader("Content-Type", ctBuf.String())
 	m.Boundary = boundary
 	m.EOL = "\r\n"
 	return m
 }
 
-// Add a message to the multipart message. EOL for the part will be inherited
-// from the multipart message.
+// Add a message to the multipart message. EOL and UTF8Headers for the part will be
+// inherited from the multipart message.
 // Returns self.
 func (m *MultipartMessage) AddPart(c *Message) *MultipartMessage {
 	m.Parts = append(m.Parts, c)
@@ -101,6 +112,8 @@ func (r *multipartReader) Read(p []byte) (n int, err error) {
 		r.buf.WriteString(r.m.EOL)
 		if len(r.m.Parts) > 0 {
 			r.m.Parts[r.cur].EOL = r.m.EOL
+			r.m.Parts[r.cur].inheritedUTF8Headers = r.m.utf8Headers()
+			r.m.Parts[r.cur].path = partPath(r.m.path, r.cur)
 		}
 	}
 
@@ -121,6 +134,8 @@ func (r *multipartReader) Read(p []byte) (n int, err error) {
 				r.buf.WriteString(r.m.Boundary)
 				if r.cur < len(r.m.Parts) {
 					r.m.Parts[r.cur].EOL = r.m.EOL
+					r.m.Parts[r.cur].inheritedUTF8Headers = r.m.utf8Headers()
+					r.m.Parts[r.cur].path = partPath(r.m.path, r.cur)
 					r.buf.WriteString(r.m.EOL)
 				} else {
 					r.buf.WriteString("--" + r.m.EOL)
@@ -133,3 +148,43 @@ func (r *multipartReader) Read(p []byte) (n int, err error) {
 
 	return n, err
 }
+
+func (r *multipartReader) reset() error {
+	for _, part := range r.m.Parts {
+		if err := part.Reset(); err != nil {
+			return err
+		}
+	}
+	r.cur = -1
+	r.buf.Reset()
+	return nil
+}
+
+// Write the parts directly to w, see Message.WriteTo
+func (r *multipartReader) writeTo(w io.Writer) error {
+	if r.m.TE != TE_7bit && r.m.TE != TE_8bit && r.m.TE != TE_binary {
+		return MultipartInvalidTransferEncoding
+	}
+
+	r.cur = len(r.m.Parts)
+	r.buf.Reset()
+	if _, err := io.WriteString(w, "--"+r.m.Boundary+r.m.EOL); err != nil {
+		return err
+	}
+	for i, part := range r.m.Parts {
+		part.EOL = r.m.EOL
+		part.inheritedUTF8Headers = r.m.utf8Headers()
+		part.path = partPath(r.m.path, i)
+		if err := part.writeTo(w); err != nil {
+			return err
+		}
+		delimiter := r.m.EOL + "--" + r.m.Boundary + r.m.EOL
+		if i == len(r.m.Parts)-1 {
+			delimiter = r.m.EOL + "--" + r.m.Boundary + "--" + r.m.EOL
+		}
+		if _, err := io.WriteString(w, delimiter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/sloonz/go-qprintable"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Parse a MIME message (headers + body), as produced by Message.Read or by any other
+// MIME-compliant software.
+//
+// The returned message mirrors what Message.Read would emit: the Content-Transfer-Encoding
+// header is removed and stored in TE, MIME-Version is dropped, and the body is decoded.
+// Reading the returned message will thus produce an equivalent MIME representation.
+// Since many messages contain 8-bit data without declaring a transfer encoding, UpgradeTE
+// is set on the parsed entities: bodies which don't conform to their transfer encoding
+// are written with quoted-printable, or with 8bit for message/* entities.
+//
+// Multipart entities are returned as the Message embedded in a MultipartMessage, whose
+// Parts and Boundary are populated ; use Message.Multipart to get it. Preamble and
+// epilogue of multipart bodies are discarded.
+//
+// The whole message is kept in memory.
+func ParseMessage(r io.Reader) (*Message, error) {
+	return parseEntity(bufio.NewReader(r), false)
+}
+
+// Returns the multipart message this message is the body of, or nil if this
+// message is not a multipart message.
+func (m *Message) Multipart() *MultipartMessage {
+	if r, ok := m.Body.(*multipartReader); ok {
+		return r.m
+	}
+	return nil
+}
+
+// Read a header block, up to and including the empty line separating it from the body.
+// Folded lines are unfolded. Also returns the end of line characters used by the header
+// ("\n" or "\r\n").
+func readHeader(r *bufio.Reader) (h Header, eol string, err error) {
+	eol = "\r\n"
+	first := true
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return h, eol, err
+		}
+		if err == io.EOF && line == "" {
+			break
+		}
+
+		if strings.HasSuffix(line, "\r\n") {
+			line = line[:len(line)-2]
+		} else if strings.HasSuffix(line, "\n") {
+			line = line[:len(line)-1]
+			if first {
+				eol = "\n"
+			}
+		}
+		first = false
+
+		if line == "" {
+			break
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(h.fields) == 0 {
+				return h, eol, MalformedHeader
+			}
+			h.fields[len(h.fields)-1].Value += line
+		} else {
+			i := strings.IndexByte(line, ':')
+			if i <= 0 {
+				return h, eol, MalformedHeader
+			}
+			// Keep the original spelling, so that the message can be written back as is
+			h.fields = append(h.fields, Field{strings.TrimRight(line[:i], " \t"), line[i+1:]})
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	for i := range h.fields {
+		h.fields[i].Value = strings.Trim(h.fields[i].Value, " \t")
+	}
+	return h, eol, nil
+}
+
+// Returns the quoted-printable encoding to use for decoding (and re-encoding) a part
+// of the given media type.
+func qpEncodingFor(mediaType string) *qprintable.Encoding {
+	if strings.HasPrefix(mediaType, "text/") {
+		return qprintable.UnixTextEncoding
+	}
+	return qprintable.BinaryEncoding
+}
+
+// Split the fields of an entity header into the headers as stored in Message.Headers
+// and the transfer encoding. Also returns the media type of the entity and, for
+// multipart entities, its boundary.
+func entityHeader(fields Header) (headers Header, te TransferEncoding, mediaType, boundary string) {
+	te = TE_7bit
+	for _, f := range fields.fields {
+		switch strings.ToLower(f.Name) {
+		case "mime-version":
+		case "content-transfer-encoding":
+			te = TransferEncoding(strings.ToLower(f.Value))
+		default:
+			headers.fields = append(headers.fields, f)
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		boundary = params["boundary"]
+	}
+	return headers, te, mediaType, boundary
+}
+
+func parseEntity(r *bufio.Reader, isMultipartPart bool) (*Message, error) {
+	fields, eol, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, te, mediaType, boundary := entityHeader(fields)
+
+	var m *Message
+	if boundary != "" {
+		mm := newMultipartMessage(boundary)
+		if err = parseMultipartBody(mm, r); err != nil {
+			return nil, err
+		}
+		m = &mm.Message
+	} else {
+		m = new(Message)
+		m.QPEncoding = qpEncodingFor(mediaType)
+		body := bytes.NewBuffer(nil)
+		if _, err = body.ReadFrom(NewTransferDecoder(te, m.QPEncoding, r)); err != nil {
+			return nil, err
+		}
+		m.Body = bytes.NewReader(body.Bytes())
+	}
+
+	m.TE = te
+	m.UpgradeTE = true
+	m.Headers = headers
+	m.EOL = eol
+	m.isMultipartPart = isMultipartPart
+	return m, nil
+}
+
+func parseMultipartBody(m *MultipartMessage, r *bufio.Reader) error {
+	// Skip preamble
+	br := newBoundaryReader(r, m.Boundary)
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return err
+	}
+
+	for !br.last {
+		br = newBoundaryReader(r, m.Boundary)
+		part, err := parseEntity(bufio.NewReader(br), true)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(io.Discard, br); err != nil {
+			return err
+		}
+		m.AddPart(part)
+	}
+
+	// Skip epilogue
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// A boundaryReader reads the content of a multipart body up to the next delimiter
+// line, which is consumed. The line break preceding the delimiter is considered part
+// of the delimiter and is not returned.
+type boundaryReader struct {
+	r         *bufio.Reader
+	dash      []byte // "--" + boundary
+	buf       []byte // data not yet returned
+	pending   string // last line break read, returned only if it's not followed by a delimiter
+	lineStart bool
+	done      bool
+	last      bool // true if the close delimiter (or end of stream) was reached
+}
+
+func newBoundaryReader(r *bufio.Reader, boundary string) *boundaryReader {
+	return &boundaryReader{r: r, dash: []byte("--" + boundary), lineStart: true}
+}
+
+// Check if line is a delimiter, and if it is the close delimiter
+func (b *boundaryReader) isDelimiter(line []byte) (delim bool, close bool) {
+	if !bytes.HasPrefix(line, b.dash) {
+		return false, false
+	}
+	rest := line[len(b.dash):]
+	if bytes.HasPrefix(rest, []byte("--")) {
+		close = true
+		rest = rest[2:]
+	}
+	return len(bytes.TrimRight(rest, " \t\r\n")) == 0, close
+}
+
+func (b *boundaryReader) fill() error {
+	line, err := b.r.ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+
+	if b.lineStart && err != bufio.ErrBufferFull {
+		if delim, close := b.isDelimiter(line); delim {
+			b.done = true
+			b.last = close || err == io.EOF
+			return nil
+		}
+	}
+
+	b.buf = append(b.buf[:0], b.pending...)
+	b.pending = ""
+	switch {
+	case err == io.EOF:
+		b.buf = append(b.buf, line...)
+		b.done = true
+		b.last = true
+	case err == bufio.ErrBufferFull:
+		b.buf = append(b.buf, line...)
+		b.lineStart = false
+	case bytes.HasSuffix(line, []byte("\r\n")):
+		b.buf = append(b.buf, line[:len(line)-2]...)
+		b.pending = "\r\n"
+		b.lineStart = true
+	default:
+		b.buf = append(b.buf, line[:len(line)-1]...)
+		b.pending = "\n"
+		b.lineStart = true
+	}
+	return nil
+}
+
+func (b *boundaryReader) Read(p []byte) (n int, err error) {
+	for len(b.buf) == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		if err = b.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
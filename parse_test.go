@@ -0,0 +1,243 @@
+package message
+
+import (
+	"bytes"
+	"github.com/sloonz/go-qprintable"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const NESTED_MESSAGE = "MIME-Version: 1.0\n" +
+	"Content-Type: multipart/mixed; boundary=outer\n" +
+	"\n" +
+	"This is the preamble.\n" +
+	"--outer\n" +
+	"Content-Type: multipart/alternative;\n" +
+	"  boundary=\"inner\"\n" +
+	"\n" +
+	"--inner\n" +
+	"Content-Type: text/plain\n" +
+	"Content-Transfer-Encoding: quoted-printable\n" +
+	"\n" +
+	"Caf=C3=A9 au =\n" +
+	"lait\n" +
+	"--inner\n" +
+	"Content-Type: text/html\n" +
+	"\n" +
+	"<p>Café</p>\n" +
+	"--inner--\n" +
+	"--outer\n" +
+	"Content-Type: application/octet-stream\n" +
+	"Content-Transfer-Encoding: base64\n" +
+	"\n" +
+	"SGVsbG8s\n" +
+	"IHdvcmxkIQ==\n" +
+	"--outer--\n" +
+	"This is the epilogue.\n"
+
+func newTestMessage() *MultipartMessage {
+	m := NewMultipartMessage("alternative", "==GoMultipartBoundary:0.")
+	m.SetHeader("Subject", EncodeWord("昨日の会議"))
+	m.SetHeader("From", EncodeWord("Miller")+" <miller@example.com>")
+	m.SetHeader("To", EncodeWord("田中")+" <tanaka@example.com>")
+	m1 := NewTextMessage(qprintable.UnixTextEncoding, bytes.NewBufferString(MESSAGE))
+	m1.SetHeader("Content-Type", "text/plain")
+	m2 := NewBinaryMessage(bytes.NewBufferString(MESSAGE))
+	m2.SetHeader("Content-Type", "application/octet-stream")
+	m.AddPart(m1)
+	m.AddPart(m2)
+	return m
+}
+
+func readAll(t *testing.T, r io.Reader) string {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Can't read: %v", err)
+	}
+	return string(data)
+}
+
+func TestParseMessage(t *testing.T) {
+	raw := readAll(t, &newTestMessage().Message)
+	m, err := ParseMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Can't parse message: %v", err)
+	}
+
+	mm := m.Multipart()
+	if mm == nil {
+		t.Fatalf("Parsed message is not multipart")
+	}
+	if mm.Boundary != "==GoMultipartBoundary:0." {
+		t.Errorf("Boundary is %#v", mm.Boundary)
+	}
+	if m.Headers.Get("Subject") != "=?UTF-8?Q?=E6=98=A8=E6=97=A5=E3=81=AE=E4=BC=9A=E8=AD=B0?=" {
+		t.Errorf("Subject is %#v", m.Headers.Get("Subject"))
+	}
+	if m.Headers.Values("Mime-Version") != nil {
+		t.Errorf("Mime-Version should not be kept in headers")
+	}
+	if len(mm.Parts) != 2 {
+		t.Fatalf("Expected 2 parts, got %d", len(mm.Parts))
+	}
+
+	expectedTE := []TransferEncoding{TE_qprintable, TE_base64}
+	expectedType := []string{"text/plain", "application/octet-stream"}
+	for i, part := range mm.Parts {
+		if part.TE != expectedTE[i] {
+			t.Errorf("Part %d: TE is %s, expected %s", i, part.TE, expectedTE[i])
+		}
+		if part.Headers.Get("Content-Type") != expectedType[i] {
+			t.Errorf("Part %d: Content-Type is %s, expected %s", i, part.Headers.Get("Content-Type"), expectedType[i])
+		}
+		if part.Headers.Values("Content-Transfer-Encoding") != nil {
+			t.Errorf("Part %d: Content-Transfer-Encoding should not be kept in headers", i)
+		}
+		if body := readAll(t, part.Body); body != MESSAGE {
+			t.Errorf("Part %d: unexpected body %#v", i, body)
+		}
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	raw := readAll(t, &newTestMessage().Message)
+	m, err := ParseMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Can't parse message: %v", err)
+	}
+	out := readAll(t, m)
+	if raw != out {
+		t.Logf("Expected:")
+		t.Logf("%#v", raw)
+		t.Logf("Message:")
+		t.Logf("%#v", out)
+		t.Fail()
+	}
+}
+
+func TestParseUndeclared8bit(t *testing.T) {
+	// 8-bit text without Content-Transfer-Encoding, as often found in the wild
+	m, err := ParseMessage(strings.NewReader("Content-Type: text/plain\r\n\r\nCaf\xc3\xa9\r\n"))
+	if err != nil {
+		t.Fatalf("Can't parse message: %v", err)
+	}
+	expected := "MIME-Version: 1.0\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: text/plain\r\n\r\nCaf=C3=A9\r\n"
+	if out := readAll(t, m); out != expected {
+		t.Errorf("Message is %#v, expected %#v", out, expected)
+	}
+}
+
+func TestParseUndeclared8bitMessage(t *testing.T) {
+	// Composite types can't use quoted-printable
+	m, err := ParseMessage(strings.NewReader("Content-Type: message/rfc822\r\n\r\nSubject: in\r\n\r\ncaf\xc3\xa9\r\n"))
+	if err != nil {
+		t.Fatalf("Can't parse message: %v", err)
+	}
+	expected := "MIME-Version: 1.0\r\nContent-Transfer-Encoding: 8bit\r\nContent-Type: message/rfc822\r\n\r\nSubject: in\r\n\r\ncaf\xc3\xa9\r\n"
+	if out := readAll(t, m); out != expected {
+		t.Errorf("Message is %#v, expected %#v", out, expected)
+	}
+
+	m, err = ParseMessage(strings.NewReader("Content-Type: message/rfc822\r\n\r\nSubject: in\r\n\r\ncaf\xc3\xa9\n"))
+	if err != nil {
+		t.Fatalf("Can't parse message: %v", err)
+	}
+	if _, err = io.ReadAll(m); err == nil || err.(*BodyError).Err != BareLineBreak {
+		t.Errorf("Expected BareLineBreak error, got %v", err)
+	}
+
+	// Line-oriented data which is not text keeps its line breaks
+	m, err = ParseMessage(strings.NewReader("Content-Type: application/x-data\r\n\r\na\xff\r\nb\r\n"))
+	if err != nil {
+		t.Fatalf("Can't parse message: %v", err)
+	}
+	if out := readAll(t, m); !strings.HasSuffix(out, "\r\n\r\na=FF\r\nb\r\n") {
+		t.Errorf("Message is %#v", out)
+	}
+}
+
+func TestParseNested(t *testing.T) {
+	m, err := ParseMessage(strings.NewReader(NESTED_MESSAGE))
+	if err != nil {
+		t.Fatalf("Can't parse message: %v", err)
+	}
+	if m.EOL != "\n" {
+		t.Errorf("EOL is %#v, expected LF", m.EOL)
+	}
+
+	outer := m.Multipart()
+	if outer == nil || len(outer.Parts) != 2 {
+		t.Fatalf("Expected a multipart message with 2 parts")
+	}
+	inner := outer.Parts[0].Multipart()
+	if inner == nil || len(inner.Parts) != 2 {
+		t.Fatalf("Expected a multipart first part with 2 parts")
+	}
+	if inner.Boundary != "inner" {
+		t.Errorf("Inner boundary is %#v", inner.Boundary)
+	}
+
+	expected := []struct {
+		m    *Message
+		body string
+	}{
+		{inner.Parts[0], "Café au lait"},
+		{inner.Parts[1], "<p>Café</p>"},
+		{outer.Parts[1], "Hello, world!"},
+	}
+	for i, e := range expected {
+		if body := readAll(t, e.m.Body); body != e.body {
+			t.Errorf("Part %d: body is %#v, expected %#v", i, body, e.body)
+		}
+	}
+}
+
+func TestPartReader(t *testing.T) {
+	expected := []struct {
+		path, contentType, body string
+	}{
+		{"1.1", "text/plain", "Café au lait"},
+		{"1.2", "text/html", "<p>Café</p>"},
+		{"2", "application/octet-stream", "Hello, world!"},
+	}
+
+	r := NewPartReader(strings.NewReader(NESTED_MESSAGE))
+	for i, e := range expected {
+		part, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("Part %d: %v", i, err)
+		}
+		if part.Path != e.path {
+			t.Errorf("Part %d: path is %#v, expected %#v", i, part.Path, e.path)
+		}
+		if part.Headers.Get("Content-Type") != e.contentType {
+			t.Errorf("Part %d: Content-Type is %#v, expected %#v", i, part.Headers.Get("Content-Type"), e.contentType)
+		}
+		// Leave the html part unread, it should be skipped
+		if i != 1 {
+			if body := readAll(t, part.Body); body != e.body {
+				t.Errorf("Part %d: body is %#v, expected %#v", i, body, e.body)
+			}
+		}
+	}
+
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("Expected EOF after last part, got %v", err)
+	}
+}
+
+func TestPartReaderSinglePart(t *testing.T) {
+	r := NewPartReader(strings.NewReader("Subject: test\r\n\r\nHello"))
+	part, err := r.NextPart()
+	if err != nil {
+		t.Fatalf("Can't read part: %v", err)
+	}
+	if part.Path != "1" || part.Headers.Get("Subject") != "test" || readAll(t, part.Body) != "Hello" {
+		t.Errorf("Unexpected part %#v", part)
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("Expected EOF after last part, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package message
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+)
+
+// A leaf entity (i.e. not multipart) of a MIME message, as returned by PartReader.NextPart.
+type Part struct {
+	// Path of the part in the message tree, as used by IMAP: "1" for the first part of
+	// the message, "1.2" for the second part of the first part, and so on. A message which
+	// is not multipart has a single part, "1".
+	Path string
+
+	// Headers of the part, in the same format than Message.Headers. The
+	// Content-Transfer-Encoding and MIME-Version headers are not included.
+	Headers Header
+
+	// Transfer encoding of the part, as declared by the Content-Transfer-Encoding header.
+	TE TransferEncoding
+
+	// The body of the part. The transfer encoding is already undone.
+	Body io.Reader
+}
+
+type partFrame struct {
+	r        *bufio.Reader
+	boundary string
+	path     string
+	index    int
+	body     *boundaryReader
+}
+
+// A PartReader walks through the leaf entities of a MIME message without keeping
+// the message in memory. Multipart entities are descended into, and their preamble and
+// epilogue are skipped.
+type PartReader struct {
+	r       *bufio.Reader
+	stack   []*partFrame
+	raw     io.Reader
+	started bool
+}
+
+// Create a new part reader reading the MIME message from r.
+func NewPartReader(r io.Reader) *PartReader {
+	return &PartReader{r: bufio.NewReader(r)}
+}
+
+// Returns the next leaf entity of the message, or io.EOF if there is none left.
+// The body of the previous part is skipped if it was not entirely read.
+func (p *PartReader) NextPart() (*Part, error) {
+	if p.raw != nil {
+		if _, err := io.Copy(io.Discard, p.raw); err != nil {
+			return nil, err
+		}
+		p.raw = nil
+	}
+
+	if !p.started {
+		p.started = true
+		if part, err := p.enter(p.r, ""); part != nil || err != nil {
+			return part, err
+		}
+	}
+
+	for len(p.stack) > 0 {
+		f := p.stack[len(p.stack)-1]
+		if _, err := io.Copy(io.Discard, f.body); err != nil {
+			return nil, err
+		}
+		if f.body.last {
+			p.stack = p.stack[:len(p.stack)-1]
+			continue
+		}
+
+		f.index++
+		f.body = newBoundaryReader(f.r, f.boundary)
+		path := strconv.Itoa(f.index)
+		if f.path != "" {
+			path = f.path + "." + path
+		}
+		if part, err := p.enter(bufio.NewReader(f.body), path); part != nil || err != nil {
+			return part, err
+		}
+	}
+
+	return nil, io.EOF
+}
+
+// Read the header of an entity. Returns the part if it's a leaf, or push a new frame
+// if it's a multipart entity.
+func (p *PartReader) enter(r *bufio.Reader, path string) (*Part, error) {
+	fields, _, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, te, mediaType, boundary := entityHeader(fields)
+	if boundary != "" {
+		p.stack = append(p.stack, &partFrame{r, boundary, path, 0, newBoundaryReader(r, boundary)})
+		return nil, nil
+	}
+
+	if path == "" {
+		path = "1"
+	}
+	p.raw = r
+	return &Part{path, headers, te, NewTransferDecoder(te, qpEncodingFor(mediaType), r)}, nil
+}
@@ -0,0 +1,145 @@
+package message
+
+import (
+	"bytes"
+	"io"
+)
+
+// Declare the length of the body, before transfer encoding (and before transcoding for
+// NewTextMessageCharset), for Size. This is only needed if it can't be known otherwise.
+// Returns self.
+func (m *Message) SetBodySize(n int64) *Message {
+	m.bodySize, m.bodySizeKnown = n, true
+	return m
+}
+
+// Returns the number of bytes Read will give, without reading the message. It must be
+// called before reading the message, or after Reset.
+//
+// The size of a body which is not transformed (7bit, 8bit or binary transfer encodings)
+// or encoded in base64 is computed from its length, which is given by SetBodySize or
+// taken from the body itself if it has a Len method (like bytes.Reader) or is an
+// io.Seeker (like os.File). Since the size of quoted-printable and transcoded bodies
+// depends on their content, they are encoded to compute it, which requires BodyFunc or
+// an io.Seeker body (rewound afterwards). UnknownSize is returned if the size can't be
+// computed.
+//
+// With AutoHeaders, the generated headers are added to Headers, so that Read gives the
+// same ones.
+func (m *Message) Size() (int64, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	if err := m.upgradeTE(); err != nil {
+		return 0, err
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := m.writeHeader(buf); err != nil {
+		return 0, err
+	}
+	n, err := m.encodedBodySize()
+	if err != nil {
+		return 0, err
+	}
+	return int64(buf.Len()) + n, nil
+}
+
+func (m *Message) encodedBodySize() (int64, error) {
+	if r, ok := m.Body.(*multipartReader); ok && m.BodyFunc == nil {
+		return r.size()
+	}
+	if m.TE == TE_qprintable || m.lineBreak != "" || m.transcoder != nil {
+		return m.countBody()
+	}
+
+	n, err := m.rawBodySize()
+	if err != nil {
+		return 0, err
+	}
+	if m.TE == TE_base64 {
+		// An end of line is written after each complete line, see base64Reader
+		encoded := (n + 2) / 3 * 4
+		return encoded + encoded/maxLineSize*int64(len(m.EOL)), nil
+	}
+	return n, nil
+}
+
+// Returns the length of the body, before transfer encoding
+func (m *Message) rawBodySize() (int64, error) {
+	if m.bodySizeKnown {
+		return m.bodySize, nil
+	}
+	if m.BodyFunc != nil {
+		return 0, UnknownSize
+	}
+
+	switch body := m.Body.(type) {
+	case *Message:
+		body.EOL = m.EOL
+		return body.Size()
+	case interface{ Len() int }:
+		return int64(body.Len()), nil
+	case io.Seeker:
+		start, err := body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		end, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = body.Seek(start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return end - start, nil
+	}
+	return 0, UnknownSize
+}
+
+// Encode the body to get its size
+func (m *Message) countBody() (int64, error) {
+	seeker, seekable := m.Body.(io.Seeker)
+	if m.BodyFunc == nil && !seekable {
+		return 0, UnknownSize
+	}
+
+	body, err := m.openBody()
+	if err != nil {
+		return 0, err
+	}
+	w := &countingWriter{io.Discard, 0}
+	if err = m.writeBody(w, body); err != nil {
+		return 0, err
+	}
+	if m.BodyFunc == nil {
+		if _, err = seeker.Seek(m.bodyStart, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	return w.n, nil
+}
+
+// Size of the multipart body, see Message.Size
+func (r *multipartReader) size() (int64, error) {
+	if r.m.TE != TE_7bit && r.m.TE != TE_8bit && r.m.TE != TE_binary {
+		return 0, MultipartInvalidTransferEncoding
+	}
+
+	eol, boundary := int64(len(r.m.EOL)), int64(len(r.m.Boundary))
+	n := 2 + boundary + eol
+	for i, part := range r.m.Parts {
+		part.EOL = r.m.EOL
+		part.inheritedUTF8Headers = r.m.utf8Headers()
+		part.path = partPath(r.m.path, i)
+		size, err := part.Size()
+		if err != nil {
+			return 0, err
+		}
+		n += size + eol + 2 + boundary + eol
+	}
+	if len(r.m.Parts) > 0 {
+		// Close delimiter
+		n += 2
+	}
+	return n, nil
+}
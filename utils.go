@@ -2,11 +2,19 @@ package message
 
 import (
 	"bytes"
+	"encoding/base64"
+	"golang.org/x/text/encoding"
+	"strings"
+	"unicode/utf8"
 )
 
 // Enforced only for base64 and quoted-printable. No limit for binary.
 const maxLineSize = 76
 
+// Maximum length of a line in a message sent by SMTP, excluding the line break
+// (RFC 5322 section 2.1.1)
+const maxSMTPLineSize = 998
+
 /**
  * Transfer encodings
  */
@@ -34,6 +42,22 @@ func (e Error) Error() string {
 var (
 	MultipartInvalidTransferEncoding = Error("multipart messages only support 7bit transfer encoding")
 	PartInvalidTransferEncoding      = Error("parts of a multipart message may not use binary or 8bit transfer encoding")
+	MalformedHeader                  = Error("malformed MIME header")
+	InvalidEncodedWord               = Error("invalid RFC 2047 encoded-word")
+	UnsupportedCharset               = Error("unsupported charset")
+	InvalidAddress                   = Error("invalid address")
+	InvalidUTF8Header                = Error("header is not valid UTF-8")
+	WriterClosed                     = Error("write to a closed part or message")
+	LineTooLong                      = Error("line longer than 998 octets")
+	NonASCIIData                     = Error("8-bit data in a 7bit body")
+	BareLineBreak                    = Error("CR or LF outside of an end of line")
+	NULCharacter                     = Error("NUL character")
+	UnknownSize                      = Error("message size can't be computed since the body length is unknown")
+	NotRewindable                    = Error("message body can't be read again")
+	InvalidHeaderName                = Error("invalid header name")
+	InvalidHeaderValue               = Error("header value contains a line break or a NUL character")
+	CannotDowngradeAddress           = Error("address with a non-ascii local part requires UTF-8 headers")
+	UnrepresentableText              = Error("text contains characters which can't be represented in the charset")
 )
 
 /**
@@ -42,6 +66,9 @@ var (
 const hexTable = "0123456789ABCDEF"
 const acceptableSpecialChars = "!*+-/="
 
+// Maximum length of an encoded-word, according to RFC 2047
+const maxEncodedWordSize = 75
+
 func isAcceptable(b byte) bool {
 	return (b >= '0' && b <= '9') ||
 		(b >= 'a' && b <= 'z') ||
@@ -49,6 +76,44 @@ func isAcceptable(b byte) bool {
 		bytes.IndexByte([]byte(acceptableSpecialChars), b) != -1
 }
 
+// Where an encoded-word is used, as defined by RFC 2047 section 5. Each context has
+// its own set of characters which may appear unencoded in Q-encoded text.
+type wordContext int
+
+const (
+	phraseContext wordContext = iota
+	commentContext
+	textContext
+)
+
+func (c wordContext) acceptable(b byte) bool {
+	if b <= ' ' || b >= 0x7f || b == '=' || b == '?' || b == '_' {
+		return false
+	}
+	switch c {
+	case phraseContext:
+		return isAcceptable(b)
+	case commentContext:
+		return b != '(' && b != ')' && b != '"' && b != '\\'
+	}
+	return true
+}
+
+// Q-encode a sequence of bytes
+func qEncode(s string, context wordContext) string {
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < len(s); i++ {
+		if context.acceptable(s[i]) {
+			buf.WriteByte(s[i])
+		} else if s[i] == byte(' ') {
+			buf.WriteByte('_')
+		} else {
+			buf.Write([]byte{'=', hexTable[s[i]>>4], hexTable[s[i]&0xf]})
+		}
+	}
+	return buf.String()
+}
+
 // Encode a word according to RFC 2047.
 // You must use this when you set headers values that does contain non-ascii characters.
 // You must encode only "phrases" (in the sense of RFC 2822) and not full headers (unless
@@ -58,7 +123,100 @@ func isAcceptable(b byte) bool {
 // and not
 //   SetHeader("To", EncodeWord("田中 <tanaka@example.com>"))
 // The phrase is assumed to be valid UTF-8.
+//
+// Encoded-words are limited to 75 characters. Longer phrases are split into several
+// encoded-words separated by spaces, without cutting UTF-8 sequences, so that
+// Message.Read can fold the header between them.
+//
+// The Q encoding is always used ; see WordEncoder to use the B encoding. See also
+// EncodePhrase, EncodeComment and EncodeText, which follow more closely the rules of
+// RFC 2047 for each kind of header content.
 func EncodeWord(w string) string {
+	return (&WordEncoder{Encoding: QWordEncoding}).EncodeWord(w)
+}
+
+// Encode a phrase (like a display name) with the default WordEncoder.
+// See WordEncoder.EncodePhrase.
+func EncodePhrase(p string) string {
+	return new(WordEncoder).EncodePhrase(p)
+}
+
+// Encode the content of a comment with the default WordEncoder.
+// See WordEncoder.EncodeComment.
+func EncodeComment(c string) string {
+	return new(WordEncoder).EncodeComment(c)
+}
+
+// Encode unstructured text (like the Subject header) with the default WordEncoder.
+// See WordEncoder.EncodeText.
+func EncodeText(t string) string {
+	return new(WordEncoder).EncodeText(t)
+}
+
+// Encoding used in encoded-words
+type WordEncoding int
+
+const (
+	// Use the shortest of Q and B encodings
+	AutoWordEncoding WordEncoding = iota
+	// Q encoding, similar to quoted-printable, which keeps ascii characters readable
+	QWordEncoding
+	// B encoding (base64), more compact for non-latin scripts
+	BWordEncoding
+)
+
+// A WordEncoder encodes phrases into RFC 2047 encoded-words.
+type WordEncoder struct {
+	// Encoding to use. By default, the one giving the shortest result is chosen.
+	Encoding WordEncoding
+
+	// Charset the phrases are transcoded to (for example "ISO-2022-JP" or "ISO-8859-1").
+	// Defaults to UTF-8. If the charset is not supported or can't represent the phrase,
+	// UTF-8 is used instead ; use NewWordEncoder and Check to detect this.
+	Charset string
+
+	// Write non-ascii characters as is instead of using encoded-words, as allowed by
+	// RFC 6532 for messages sent to a server supporting SMTPUTF8. Quoting and escaping
+	// are still applied, and control characters are still encoded.
+	UTF8 bool
+}
+
+// Create an encoder transcoding phrases to the given charset. Returns UnsupportedCharset
+// if the charset is not supported, like NewTextMessageCharset.
+func NewWordEncoder(charset string) (*WordEncoder, error) {
+	if !isUTF8Charset(charset) {
+		if _, err := lookupCharset(charset); err != nil {
+			return nil, err
+		}
+	}
+	return &WordEncoder{Charset: charset}, nil
+}
+
+// Check that s can be encoded in the charset of the encoder. Returns UnsupportedCharset
+// if the charset is not supported, and UnrepresentableText if some characters of s
+// can't be represented in it ; in both cases, the Encode methods use UTF-8 instead.
+func (e *WordEncoder) Check(s string) error {
+	if e.Charset == "" || isUTF8Charset(e.Charset) {
+		return nil
+	}
+	enc, err := lookupCharset(e.Charset)
+	if err != nil {
+		return err
+	}
+	if _, err = enc.NewEncoder().String(s); err != nil {
+		return UnrepresentableText
+	}
+	return nil
+}
+
+// Encode a word according to RFC 2047, like EncodeWord, but with the encoding
+// specified by the encoder. With AutoWordEncoding, the B encoding is chosen when it gives
+// a shorter result than the Q encoding, which is typically the case for CJK text.
+func (e *WordEncoder) EncodeWord(w string) string {
+	if e.UTF8 && !e.needsTextEncoding(w) {
+		return w
+	}
+
 	// If it's ascii, no need to encode it (more readable)
 	ascii := true
 	for i := 0; i < len(w) && ascii; i++ {
@@ -70,17 +228,179 @@ func EncodeWord(w string) string {
 		return w
 	}
 
-	// Else, encode the word
-	buf := bytes.NewBufferString("=?UTF-8?Q?")
+	return e.encode(w, phraseContext)
+}
+
+// Encode a phrase (the display name of an address, for example), as defined by RFC 5322.
+// Phrases made of atoms are returned as is, and other ascii phrases are returned as a
+// quoted-string. Otherwise, only the words which need it are encoded, so that the result
+// stays as readable as possible.
+func (e *WordEncoder) EncodePhrase(p string) string {
+	atoms, printable := true, true
+	for i := 0; i < len(p); i++ {
+		if p[i] != ' ' && !isAtext(p[i]) && !(e.UTF8 && p[i] >= 0x80) {
+			atoms = false
+		}
+		if !e.isPrintable(p[i]) {
+			printable = false
+		}
+	}
+	if atoms && p != "" && strings.TrimSpace(p) == p && !looksEncoded(p) {
+		return p
+	}
+	if printable {
+		return quoteString(p)
+	}
+
+	return e.encodeWords(p, func(w string) bool {
+		for i := 0; i < len(w); i++ {
+			if !isAtext(w[i]) {
+				return true
+			}
+		}
+		return looksEncoded(w)
+	}, nil, phraseContext)
+}
+
+// Encode the content of a comment (the text between parentheses), as defined by RFC 5322.
+// Words which contain non-ascii characters are encoded ; in other words, parentheses and
+// backslashes are escaped. The returned value does not include the enclosing parentheses.
+func (e *WordEncoder) EncodeComment(c string) string {
+	escaper := strings.NewReplacer("\\", "\\\\", "(", "\\(", ")", "\\)")
+	return e.encodeWords(c, e.needsTextEncoding, escaper.Replace, commentContext)
+}
+
+// Encode unstructured text (like the Subject header). Only the words which contain
+// non-ascii characters (or which could be mistaken for encoded-words) are encoded,
+// which keeps ascii words readable.
+func (e *WordEncoder) EncodeText(t string) string {
+	return e.encodeWords(t, e.needsTextEncoding, nil, textContext)
+}
+
+func isAtext(b byte) bool {
+	return (b >= '0' && b <= '9') ||
+		(b >= 'a' && b <= 'z') ||
+		(b >= 'A' && b <= 'Z') ||
+		strings.IndexByte("!#$%&'*+-/=?^_`{|}~", b) != -1
+}
+
+func looksEncoded(w string) bool {
+	return strings.Contains(w, "=?")
+}
+
+// Returns true if b can be written as is in an header. Non-ascii characters are only
+// allowed in UTF-8 mode.
+func (e *WordEncoder) isPrintable(b byte) bool {
+	return b >= ' ' && b != 0x7f && (b < 0x80 || e.UTF8)
+}
+
+func (e *WordEncoder) needsTextEncoding(w string) bool {
 	for i := 0; i < len(w); i++ {
-		if isAcceptable(w[i]) {
-			buf.WriteByte(w[i])
-		} else if w[i] == byte(' ') {
-			buf.WriteByte('_')
-		} else {
-			buf.Write([]byte{'=', hexTable[w[i]>>4], hexTable[w[i]&0xf]})
+		if !e.isPrintable(w[i]) {
+			return true
 		}
 	}
-	buf.WriteString("?=")
+	return looksEncoded(w)
+}
+
+// Returns s as a quoted-string
+func quoteString(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
+
+// Encode the words of s for which needsEncoding returns true, and apply plain (if not
+// nil) to the other ones. Whitespace between two adjacent words to encode is ignored by
+// decoders, so it's encoded with them in the same encoded-words.
+func (e *WordEncoder) encodeWords(s string, needsEncoding func(string) bool, plain func(string) string, context wordContext) string {
+	// Split into alternating words and whitespace sequences
+	var tokens []string
+	for i := 0; i < len(s); {
+		j := i
+		space := s[i] == ' ' || s[i] == '\t'
+		for j < len(s) && (s[j] == ' ' || s[j] == '\t') == space {
+			j++
+		}
+		tokens = append(tokens, s[i:j])
+		i = j
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < len(tokens); {
+		tok := tokens[i]
+		if tok[0] == ' ' || tok[0] == '\t' || !needsEncoding(tok) {
+			if plain != nil {
+				tok = plain(tok)
+			}
+			buf.WriteString(tok)
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j+1 < len(tokens) && needsEncoding(tokens[j+1]) {
+			j += 2
+		}
+		buf.WriteString(e.encode(strings.Join(tokens[i:j], ""), context))
+		i = j
+	}
 	return buf.String()
 }
+
+// Encode w into one or several encoded-words
+func (e *WordEncoder) encode(w string, context wordContext) string {
+	charset, transcoder := "UTF-8", encoding.Encoding(nil)
+	if e.Charset != "" && !isUTF8Charset(e.Charset) {
+		if enc, err := lookupCharset(e.Charset); err == nil {
+			if _, err = enc.NewEncoder().String(w); err == nil {
+				charset, transcoder = e.Charset, enc
+			}
+		}
+	}
+
+	switch e.Encoding {
+	case QWordEncoding:
+		return splitEncodedWords(w, charset, transcoder, 'Q', context)
+	case BWordEncoding:
+		return splitEncodedWords(w, charset, transcoder, 'B', context)
+	}
+	q := splitEncodedWords(w, charset, transcoder, 'Q', context)
+	b := splitEncodedWords(w, charset, transcoder, 'B', context)
+	if len(b) < len(q) {
+		return b
+	}
+	return q
+}
+
+// Transcode s (if transcoder is not nil) and encode it
+func encodeText(s string, transcoder encoding.Encoding, method byte, context wordContext) string {
+	if transcoder != nil {
+		// Errors have been checked on the whole phrase
+		s, _ = transcoder.NewEncoder().String(s)
+	}
+	if method == 'B' {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	return qEncode(s, context)
+}
+
+// Encode w into encoded-words, one character at a time, starting a new encoded-word
+// when the current one is full. Each encoded-word is transcoded independently, so that
+// it's self-contained even for stateful charsets like ISO-2022-JP.
+func splitEncodedWords(w, charset string, transcoder encoding.Encoding, method byte, context wordContext) string {
+	prefix, suffix := "=?"+charset+"?"+string(method)+"?", "?="
+	var words []string
+	start, last := 0, ""
+	for i := 0; i < len(w); {
+		_, size := utf8.DecodeRuneInString(w[i:])
+		encoded := encodeText(w[start:i+size], transcoder, method, context)
+		if len(prefix)+len(encoded)+len(suffix) > maxEncodedWordSize && i > start {
+			words = append(words, prefix+last+suffix)
+			start = i
+			encoded = encodeText(w[start:i+size], transcoder, method, context)
+		}
+		last = encoded
+		i += size
+	}
+	words = append(words, prefix+last+suffix)
+	return strings.Join(words, " ")
+}
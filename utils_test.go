@@ -1,6 +1,7 @@
 package message
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -18,3 +19,155 @@ func TestEncodeWord(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeWordLong(t *testing.T) {
+	w := "昨日の会議の議事録を共有します。ご確認のほどよろしくお願いいたします。"
+	encoded := EncodeWord(w)
+	words := strings.Split(encoded, " ")
+	if len(words) < 2 {
+		t.Errorf("EncodeWord(%#v) should produce several encoded-words, got %#v", w, encoded)
+	}
+	for _, word := range words {
+		if len(word) > 75 {
+			t.Errorf("Encoded-word %#v is longer than 75 characters", word)
+		}
+		if _, err := DecodeWord(word); err != nil {
+			t.Errorf("Encoded-word %#v is invalid: %v", word, err)
+		}
+	}
+	if decoded, err := DecodeHeader(encoded); err != nil || decoded != w {
+		t.Errorf("DecodeHeader(%#v) should be %#v, got %#v (%v)", encoded, w, decoded, err)
+	}
+}
+
+var wordEncoderData = []struct {
+	encoding         WordEncoding
+	decoded, encoded string
+}{
+	{AutoWordEncoding, "test", "test"},
+	{AutoWordEncoding, "Bonjour à tous!", "=?UTF-8?Q?Bonjour_=C3=A0_tous!?="},
+	{AutoWordEncoding, "昨日の会議", "=?UTF-8?B?5pio5pel44Gu5Lya6K2w?="},
+	{QWordEncoding, "昨日の会議", "=?UTF-8?Q?=E6=98=A8=E6=97=A5=E3=81=AE=E4=BC=9A=E8=AD=B0?="},
+	{BWordEncoding, "Bonjour à tous!", "=?UTF-8?B?Qm9uam91ciDDoCB0b3VzIQ==?="},
+}
+
+func TestWordEncoder(t *testing.T) {
+	for _, data := range wordEncoderData {
+		e := &WordEncoder{Encoding: data.encoding}
+		if encoded := e.EncodeWord(data.decoded); encoded != data.encoded {
+			t.Errorf("EncodeWord(%#v) with encoding %d should be %#v, got %#v", data.decoded, data.encoding, data.encoded, encoded)
+		}
+	}
+}
+
+func TestWordEncoderLong(t *testing.T) {
+	w := "昨日の会議の議事録を共有します。ご確認のほどよろしくお願いいたします。"
+	encoded := new(WordEncoder).EncodeWord(w)
+	for _, word := range strings.Split(encoded, " ") {
+		if len(word) > 75 || !strings.HasPrefix(word, "=?UTF-8?B?") {
+			t.Errorf("Unexpected encoded-word %#v", word)
+		}
+	}
+	if decoded, err := DecodeHeader(encoded); err != nil || decoded != w {
+		t.Errorf("DecodeHeader(%#v) should be %#v, got %#v (%v)", encoded, w, decoded, err)
+	}
+}
+
+var charsetEncoderData = []struct {
+	charset          string
+	encoding         WordEncoding
+	decoded, encoded string
+}{
+	{"ISO-2022-JP", BWordEncoding, "田中", "=?ISO-2022-JP?B?GyRCRURDZhsoQg==?="},
+	{"ISO-8859-1", QWordEncoding, "Café", "=?ISO-8859-1?Q?Caf=E9?="},
+	{"ISO-8859-1", QWordEncoding, "田中", "=?UTF-8?Q?=E7=94=B0=E4=B8=AD?="},
+	{"X-UNKNOWN", QWordEncoding, "Café", "=?UTF-8?Q?Caf=C3=A9?="},
+}
+
+func TestWordEncoderCharset(t *testing.T) {
+	for _, data := range charsetEncoderData {
+		e := &WordEncoder{Encoding: data.encoding, Charset: data.charset}
+		if encoded := e.EncodeWord(data.decoded); encoded != data.encoded {
+			t.Errorf("EncodeWord(%#v) with charset %s should be %#v, got %#v", data.decoded, data.charset, data.encoded, encoded)
+		}
+	}
+
+	e, err := NewWordEncoder("ISO-8859-1")
+	if err != nil {
+		t.Fatalf("Can't create encoder: %v", err)
+	}
+	if err = e.Check("Café"); err != nil {
+		t.Errorf("Check(\"Café\") failed: %v", err)
+	}
+	if err = e.Check("田中"); err != UnrepresentableText {
+		t.Errorf("Expected UnrepresentableText error, got %v", err)
+	}
+	if _, err = NewWordEncoder("X-UNKNOWN"); err != UnsupportedCharset {
+		t.Errorf("Expected UnsupportedCharset error, got %v", err)
+	}
+	if err = (&WordEncoder{Charset: "X-UNKNOWN"}).Check("Café"); err != UnsupportedCharset {
+		t.Errorf("Expected UnsupportedCharset error, got %v", err)
+	}
+
+	// Every encoded-word must be self-contained
+	w := strings.Repeat("昨日の会議", 10)
+	encoded := (&WordEncoder{Charset: "ISO-2022-JP"}).EncodeWord(w)
+	for _, word := range strings.Split(encoded, " ") {
+		if len(word) > 75 {
+			t.Errorf("Encoded-word %#v is longer than 75 characters", word)
+		}
+		if _, err := DecodeWord(word); err != nil {
+			t.Errorf("Encoded-word %#v is invalid: %v", word, err)
+		}
+	}
+	if decoded, err := DecodeHeader(encoded); err != nil || decoded != w {
+		t.Errorf("DecodeHeader(%#v) should be %#v, got %#v (%v)", encoded, w, decoded, err)
+	}
+}
+
+var contextEncoder = &WordEncoder{Encoding: QWordEncoding}
+var utf8Encoder = &WordEncoder{UTF8: true}
+
+var contextEncoderData = []struct {
+	encode           func(string) string
+	decoded, encoded string
+}{
+	{contextEncoder.EncodePhrase, "John Smith", "John Smith"},
+	{contextEncoder.EncodePhrase, "Smith, John", "\"Smith, John\""},
+	{contextEncoder.EncodePhrase, "John \"Johnny\" Smith", "\"John \\\"Johnny\\\" Smith\""},
+	{contextEncoder.EncodePhrase, "François Dupont", "=?UTF-8?Q?Fran=C3=A7ois?= Dupont"},
+	{contextEncoder.EncodePhrase, "Dupont, François", "=?UTF-8?Q?Dupont=2C_Fran=C3=A7ois?="},
+	{contextEncoder.EncodePhrase, "a=?b", "\"a=?b\""},
+	{contextEncoder.EncodeComment, "a (nested) comment", "a \\(nested\\) comment"},
+	{contextEncoder.EncodeComment, "café (au lait)", "=?UTF-8?Q?caf=C3=A9?= \\(au lait\\)"},
+	{contextEncoder.EncodeComment, "(café)", "=?UTF-8?Q?=28caf=C3=A9=29?="},
+	{contextEncoder.EncodeText, "Meeting: café at 10:00?", "Meeting: =?UTF-8?Q?caf=C3=A9?= at 10:00?"},
+	{contextEncoder.EncodeText, "Réunion à 10h (salle B)", "=?UTF-8?Q?R=C3=A9union_=C3=A0?= 10h (salle B)"},
+	{contextEncoder.EncodeText, "A=?B?C?=", "=?UTF-8?Q?A=3D=3FB=3FC=3F=3D?="},
+	{contextEncoder.EncodeText, "(1+1=2) €", "(1+1=2) =?UTF-8?Q?=E2=82=AC?="},
+	{contextEncoder.EncodeText, "café(1)", "=?UTF-8?Q?caf=C3=A9(1)?="},
+	{EncodeText, "昨日の会議 2", "=?UTF-8?B?5pio5pel44Gu5Lya6K2w?= 2"},
+	{utf8Encoder.EncodeWord, "田中", "田中"},
+	{utf8Encoder.EncodeWord, "a\x01b", "=?UTF-8?B?YQFi?="},
+	{utf8Encoder.EncodePhrase, "François Dupont", "François Dupont"},
+	{utf8Encoder.EncodePhrase, "Dupont, François", "\"Dupont, François\""},
+	{utf8Encoder.EncodeComment, "café (au lait)", "café \\(au lait\\)"},
+	{utf8Encoder.EncodeText, "Réunion à 10h", "Réunion à 10h"},
+	{utf8Encoder.EncodeText, "A=?B?C?=", "=?UTF-8?B?QT0/Qj9DPz0=?="},
+}
+
+func TestContextEncoders(t *testing.T) {
+	for _, data := range contextEncoderData {
+		encoded := data.encode(data.decoded)
+		if encoded != data.encoded {
+			t.Errorf("Encoding %#v should give %#v, got %#v", data.decoded, data.encoded, encoded)
+		}
+	}
+
+	for _, text := range []string{"Réunion à 10h", "Ré  union  à 10h", "a é b"} {
+		encoded := EncodeText(text)
+		if decoded, err := DecodeHeader(encoded); err != nil || decoded != text {
+			t.Errorf("DecodeHeader(%#v) should be %#v, got %#v (%v)", encoded, text, decoded, err)
+		}
+	}
+}
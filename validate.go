@@ -0,0 +1,236 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/sloonz/go-qprintable"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Error returned when the body of a 7bit or 8bit entity doesn't conform to its transfer
+// encoding. Err is one of LineTooLong, NonASCIIData, BareLineBreak or NULCharacter.
+type BodyError struct {
+	// Path of the part, as in Part.Path: "1" for a message which is not multipart, "1.2"
+	// for the second part of the first part, and so on.
+	Part string
+
+	// Line of the body where the error was found, starting at 1
+	Line int
+
+	Err error
+}
+
+func (e *BodyError) Error() string {
+	return fmt.Sprintf("part %s, line %d: %v", e.Part, e.Line, e.Err)
+}
+
+// Returns the path of the index-th part (starting at 0) of the entity at path parent
+func partPath(parent string, index int) string {
+	if parent == "" {
+		return strconv.Itoa(index + 1)
+	}
+	return parent + "." + strconv.Itoa(index+1)
+}
+
+// Checks that data conforms to the 7bit or 8bit transfer encoding (RFC 2045 section
+// 2.7 and 2.8): no NUL, CR and LF only as part of the end of line, lines of at most 998
+// octets, and no 8-bit data for 7bit.
+type bodyValidator struct {
+	te       TransferEncoding
+	eol      string
+	part     string
+	line     int
+	lineSize int
+	cr       bool // last byte was a CR, which must be followed by a LF
+	err      error
+}
+
+func newBodyValidator(m *Message) *bodyValidator {
+	part := m.path
+	if part == "" {
+		part = "1"
+	}
+	return &bodyValidator{te: m.TE, eol: m.EOL, part: part, line: 1}
+}
+
+func (v *bodyValidator) fail(err error) error {
+	v.err = &BodyError{v.part, v.line, err}
+	return v.err
+}
+
+func (v *bodyValidator) check(p []byte) error {
+	if v.err != nil {
+		return v.err
+	}
+	for _, b := range p {
+		if v.cr {
+			v.cr = false
+			if b == '\n' {
+				v.line++
+				v.lineSize = 0
+				continue
+			}
+			return v.fail(BareLineBreak)
+		}
+
+		switch {
+		case b == '\r' && v.eol == "\r\n":
+			v.cr = true
+			continue
+		case b == '\n' && v.eol == "\n":
+			v.line++
+			v.lineSize = 0
+			continue
+		case b == '\r' || b == '\n':
+			return v.fail(BareLineBreak)
+		case b == 0:
+			return v.fail(NULCharacter)
+		case b >= 0x80 && v.te == TE_7bit:
+			return v.fail(NonASCIIData)
+		}
+
+		v.lineSize++
+		if v.lineSize > maxSMTPLineSize {
+			return v.fail(LineTooLong)
+		}
+	}
+	return nil
+}
+
+// Check the end of the data
+func (v *bodyValidator) close() error {
+	if v.err == nil && v.cr {
+		return v.fail(BareLineBreak)
+	}
+	return v.err
+}
+
+type validatingReader struct {
+	r io.Reader
+	v *bodyValidator
+}
+
+func (r *validatingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if verr := r.v.check(p[:n]); verr != nil {
+		return 0, verr
+	}
+	if err == io.EOF {
+		if verr := r.v.close(); verr != nil {
+			return 0, verr
+		}
+	}
+	return n, err
+}
+
+type validatingWriter struct {
+	w io.Writer
+	v *bodyValidator
+}
+
+func (w *validatingWriter) Write(p []byte) (int, error) {
+	if err := w.v.check(p); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// Returns true if the body of the message must be validated (see bodyValidator)
+func (m *Message) needsValidation() bool {
+	if m.TE != TE_7bit && m.TE != TE_8bit {
+		return false
+	}
+	_, multipart := m.Body.(*multipartReader)
+	return !multipart || m.BodyFunc != nil
+}
+
+// Returns the body as written for 7bit, 8bit or binary transfer encodings, validated
+// if needed
+func (m *Message) plainBodyReader(body io.Reader) io.Reader {
+	if m.lineBreak != "" {
+		body = &eolReader{m.EOL, m.lineBreak, bufio.NewReader(body), bytes.NewBuffer(nil)}
+	}
+	if m.needsValidation() {
+		body = &validatingReader{body, newBodyValidator(m)}
+	}
+	return body
+}
+
+// If UpgradeTE is set, check the body of a 7bit or 8bit message before writing it, and
+// switch to quoted-printable if it doesn't conform. Composite types (message/* and
+// multipart/*) can't use quoted-printable (RFC 2045 section 6.4): they are switched to
+// 8bit if the only problem is 8-bit data in a 7bit body, and the error is returned
+// otherwise.
+func (m *Message) upgradeTE() error {
+	if !m.UpgradeTE || !m.needsValidation() {
+		return nil
+	}
+	if _, embedded := m.Body.(*Message); embedded && m.BodyFunc == nil {
+		return nil
+	}
+
+	// Make sure the body can be read again
+	if _, seekable := m.Body.(io.Seeker); m.BodyFunc == nil && !seekable {
+		data, err := io.ReadAll(m.Body)
+		if err != nil {
+			return err
+		}
+		m.Body = bytes.NewReader(data)
+		m.seekable = false
+	}
+
+	err := m.checkBody()
+	bodyErr, invalid := err.(*BodyError)
+	if !invalid {
+		return err
+	}
+	if isCompositeType(m.Headers.Get("Content-Type")) {
+		if bodyErr.Err != NonASCIIData {
+			return err
+		}
+		m.TE = TE_8bit
+		return m.checkBody()
+	}
+
+	// The body is made of lines ending with lineBreak (or EOL), which are kept as is
+	m.TE = TE_qprintable
+	lineBreak := m.lineBreak
+	if lineBreak == "" {
+		lineBreak = m.EOL
+	}
+	m.QPEncoding = qprintable.WindowsTextEncoding
+	if lineBreak == "\n" {
+		m.QPEncoding = qprintable.UnixTextEncoding
+	}
+	return nil
+}
+
+// Validate the body (see bodyValidator) and rewind it. Body must be an io.Seeker if
+// BodyFunc is not set.
+func (m *Message) checkBody() error {
+	body, err := m.openBody()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, m.plainBodyReader(body))
+	if m.BodyFunc == nil {
+		if _, serr := m.Body.(io.Seeker).Seek(m.bodyStart, io.SeekStart); serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+// Returns true if the media type of contentType is message/* or multipart/*, which
+// only accept the 7bit, 8bit and binary transfer encodings
+func isCompositeType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "message/") || strings.HasPrefix(mediaType, "multipart/")
+}
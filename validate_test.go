@@ -0,0 +1,99 @@
+package message
+
+import (
+	"bytes"
+	"github.com/sloonz/go-qprintable"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func new7bitMessage(body string) *Message {
+	m := NewTextMessage(qprintable.UnixTextEncoding, strings.NewReader(body))
+	m.TE = TE_7bit
+	return m
+}
+
+var bodyErrorData = []struct {
+	te   TransferEncoding
+	body string
+	err  *BodyError
+}{
+	{TE_7bit, "Hello\r\nworld\r\n", nil},
+	{TE_7bit, "Hello\r\ncafé\r\n", &BodyError{"1", 2, NonASCIIData}},
+	{TE_8bit, "Hello\r\ncafé\r\n", nil},
+	{TE_8bit, "Hello\r\n\r\nwor\x00ld\r\n", &BodyError{"1", 3, NULCharacter}},
+	{TE_7bit, "Hello\nworld\r\n", &BodyError{"1", 1, BareLineBreak}},
+	{TE_7bit, "Hello\r\nworld\r", &BodyError{"1", 2, BareLineBreak}},
+	{TE_7bit, strings.Repeat("a", 998) + "\r\n", nil},
+	{TE_7bit, "Hello\r\n" + strings.Repeat("a", 999), &BodyError{"1", 2, LineTooLong}},
+	{TE_binary, "Hello\nwor\x00ld\r", nil},
+}
+
+func TestBodyValidation(t *testing.T) {
+	for _, data := range bodyErrorData {
+		m := new7bitMessage(data.body)
+		m.TE = data.te
+		_, err := io.ReadAll(m)
+		if data.err == nil && err != nil {
+			t.Errorf("Body %#v should be valid, got %v", data.body, err)
+		} else if data.err != nil && !reflect.DeepEqual(err, data.err) {
+			t.Errorf("Body %#v should give %#v, got %#v", data.body, data.err, err)
+		}
+	}
+}
+
+func TestBodyValidationPath(t *testing.T) {
+	inner := NewMultipartMessage("alternative", "==GoMultipartBoundary:1.")
+	inner.AddPart(new7bitMessage("Hello\r\n")).AddPart(new7bitMessage("Hello\r\nwor\x00ld\r\n"))
+	m := NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+	m.AddPart(new7bitMessage("Hello\r\n")).AddPart(&inner.Message)
+
+	expected := &BodyError{"2.2", 2, NULCharacter}
+	if _, err := io.ReadAll(m); !reflect.DeepEqual(err, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, err)
+	}
+	if err := m.Reset(); err != nil {
+		t.Fatalf("Can't reset message: %v", err)
+	}
+	if _, err := m.WriteTo(io.Discard); !reflect.DeepEqual(err, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, err)
+	}
+	if expected.Error() != "part 2.2, line 2: NUL character" {
+		t.Errorf("Unexpected error message %#v", expected.Error())
+	}
+
+	w := NewWriter(io.Discard, "mixed", "==GoMultipartBoundary:0.")
+	w.CreatePart(new7bitMessage(""))
+	pw, _ := w.CreatePart(new7bitMessage(""))
+	io.WriteString(pw, "Hello\r\n")
+	if _, err := io.WriteString(pw, "café\r\n"); !reflect.DeepEqual(err, &BodyError{"2", 2, NonASCIIData}) {
+		t.Errorf("Expected NonASCIIData error from the writer, got %#v", err)
+	}
+}
+
+func TestUpgradeTE(t *testing.T) {
+	for _, body := range []io.Reader{bytes.NewBufferString("Un café\r\n"), strings.NewReader("Un café\r\n")} {
+		m := NewBinaryMessage(body)
+		m.TE = TE_7bit
+		m.UpgradeTE = true
+		size, err := m.Size()
+		if err != nil {
+			t.Fatalf("Can't compute size: %v", err)
+		}
+		expected := "MIME-Version: 1.0\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Un caf=C3=A9\r\n"
+		if s := readAll(t, m); s != expected || int64(len(s)) != size {
+			t.Errorf("Message is %#v (size %d), expected %#v", s, size, expected)
+		}
+	}
+
+	m := new7bitMessage("Hello\r\n")
+	m.UpgradeTE = true
+	if s := readAll(t, m); m.TE != TE_7bit || !strings.HasSuffix(s, "\r\n\r\nHello\r\n") {
+		t.Errorf("Valid 7bit body should not be upgraded, got %#v", s)
+	}
+}
@@ -0,0 +1,241 @@
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/sloonz/go-qprintable"
+	"golang.org/x/text/transform"
+	"io"
+)
+
+// A Writer writes a multipart message incrementally: instead of giving readers for the
+// bodies of the parts, the content of each part is written by the caller. The output is
+// the same as the one of the equivalent MultipartMessage.
+type Writer struct {
+	// The multipart message being written, which defines its headers, EOL and other
+	// settings. It can be modified until the first part is created (or the writer is
+	// closed) ; its Parts are not used.
+	Message *MultipartMessage
+
+	w       io.Writer
+	parent  *Writer
+	part    *partWriter
+	child   *Writer
+	parts   int
+	started bool
+	closed  bool
+	err     error
+}
+
+// Create a new writer, writing a multipart message to w. subtype and boundary are the
+// same as in NewMultipartMessage.
+func NewWriter(w io.Writer, subtype, boundary string) *Writer {
+	return &Writer{Message: NewMultipartMessage(subtype, boundary), w: w}
+}
+
+// Set an header of the multipart message, see Message.SetHeader. It must be called
+// before the first part is created.
+// Returns self.
+func (w *Writer) SetHeader(name, val string) *Writer {
+	w.Message.SetHeader(name, val)
+	return w
+}
+
+func (w *Writer) write(s string) error {
+	if w.err == nil {
+		_, w.err = io.WriteString(w.w, s)
+	}
+	return w.err
+}
+
+// Finish the current part, and write the header of the message if it's not done yet
+func (w *Writer) begin() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return WriterClosed
+	}
+
+	if w.part != nil {
+		if err := w.part.Close(); err != nil {
+			return err
+		}
+	}
+	if w.child != nil {
+		if err := w.child.Close(); err != nil {
+			return err
+		}
+	}
+
+	if !w.started {
+		w.started = true
+		if w.Message.TE != TE_7bit && w.Message.TE != TE_8bit && w.Message.TE != TE_binary {
+			w.err = MultipartInvalidTransferEncoding
+			return w.err
+		}
+		buf := bytes.NewBuffer(nil)
+		if w.err = w.Message.writeHeader(buf); w.err != nil {
+			return w.err
+		}
+		buf.WriteString("--" + w.Message.Boundary + w.Message.EOL)
+		return w.write(buf.String())
+	}
+	return nil
+}
+
+// Prepare the writing of a new part
+func (w *Writer) startPart() error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	if w.parts > 0 {
+		// End of the delimiter line written after the previous part
+		return w.write(w.Message.EOL)
+	}
+	return nil
+}
+
+// Called when the current part is finished
+func (w *Writer) endPart() error {
+	w.part, w.child = nil, nil
+	w.parts++
+	return w.write(w.Message.EOL + "--" + w.Message.Boundary)
+}
+
+// Add a new part to the message, and return a writer for its content. part is used as a
+// template: its headers, transfer encoding and QPEncoding are used, but its body is
+// not. EOL and UTF8Headers are inherited from the multipart message, like with AddPart.
+// The content written is converted and encoded like the body of the part would be when
+// reading it (charset, line breaks of NewAutoMessage, transfer encoding).
+//
+// The returned writer must be closed before creating the next part, or it's closed
+// automatically.
+func (w *Writer) CreatePart(part *Message) (io.WriteCloser, error) {
+	if err := w.startPart(); err != nil {
+		return nil, err
+	}
+
+	part.EOL = w.Message.EOL
+	part.inheritedUTF8Headers = w.Message.utf8Headers()
+	part.isMultipartPart = true
+	part.path = partPath(w.Message.path, w.parts)
+	buf := bytes.NewBuffer(nil)
+	if w.err = part.writeHeader(buf); w.err != nil {
+		return nil, w.err
+	}
+	if err := w.write(buf.String()); err != nil {
+		return nil, err
+	}
+
+	// Same conversions as when reading a message, see openBody and newBodyReader
+	pw := &partWriter{w: w, encoder: w.w}
+	if part.TE == TE_qprintable {
+		pw.encoder = qprintable.NewEncoderWithEOL(part.EOL, part.QPEncoding, pw.encoder)
+	} else if part.TE == TE_base64 {
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{pw.encoder, []byte(part.EOL), 0})
+		pw.encoder, pw.closers = encoder, append(pw.closers, encoder)
+	} else if part.needsValidation() {
+		pw.validator = newBodyValidator(part)
+		pw.encoder = &validatingWriter{pw.encoder, pw.validator}
+	}
+	if part.lineBreak != "" {
+		eol := part.EOL
+		if part.TE == TE_base64 {
+			eol = "\r\n"
+		}
+		converter := &eolWriter{w: pw.encoder, eol: eol, lineBreak: part.lineBreak}
+		pw.encoder, pw.closers = converter, append([]io.Closer{converter}, pw.closers...)
+	}
+	if part.transcoder != nil {
+		transcoder := transform.NewWriter(pw.encoder, part.transcoder.NewEncoder())
+		pw.encoder, pw.closers = transcoder, append([]io.Closer{transcoder}, pw.closers...)
+	}
+	w.part = pw
+	return pw, nil
+}
+
+// Add a new multipart part to the message, and return a writer for it. subtype and
+// boundary are the same as in NewMultipartMessage.
+//
+// The returned writer must be closed before creating the next part, or it's closed
+// automatically.
+func (w *Writer) CreateMultipart(subtype, boundary string) (*Writer, error) {
+	if err := w.startPart(); err != nil {
+		return nil, err
+	}
+
+	child := NewWriter(w.w, subtype, boundary)
+	child.parent = w
+	child.Message.EOL = w.Message.EOL
+	child.Message.inheritedUTF8Headers = w.Message.utf8Headers()
+	child.Message.isMultipartPart = true
+	child.Message.path = partPath(w.Message.path, w.parts)
+	w.child = child
+	return child, nil
+}
+
+// Finish the message: close the current part and write the close delimiter. This does
+// not close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	if err := w.begin(); err != nil {
+		return err
+	}
+	w.closed = true
+	if w.parts > 0 {
+		if err := w.write("--" + w.Message.EOL); err != nil {
+			return err
+		}
+	}
+	if w.parent != nil && w.parent.child == w {
+		if err := w.parent.endPart(); err != nil {
+			return err
+		}
+	}
+	return w.err
+}
+
+// Writer for the content of a part, see Writer.CreatePart
+type partWriter struct {
+	w         *Writer
+	encoder   io.Writer
+	closers   []io.Closer    // encoders to flush, in order
+	validator *bodyValidator // also in the encoders if the body is validated
+	closed    bool
+}
+
+func (p *partWriter) Write(b []byte) (int, error) {
+	if p.closed {
+		return 0, WriterClosed
+	}
+	if p.w.err != nil {
+		return 0, p.w.err
+	}
+	n, err := p.encoder.Write(b)
+	if err != nil {
+		p.w.err = err
+	}
+	return n, err
+}
+
+func (p *partWriter) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	for _, c := range p.closers {
+		if err := c.Close(); err != nil && p.w.err == nil {
+			p.w.err = err
+		}
+	}
+	if p.validator != nil && p.w.err == nil {
+		p.w.err = p.validator.close()
+	}
+	if p.w.err != nil {
+		return p.w.err
+	}
+	return p.w.endPart()
+}
@@ -0,0 +1,117 @@
+package message
+
+import (
+	"bytes"
+	"github.com/sloonz/go-qprintable"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	text := strings.Repeat(MESSAGE+" Café.\n", 5)
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for _, eol := range []string{"\r\n", "\n"} {
+		// Reader-based message
+		latin1, _ := NewTextMessageCharset(qprintable.UnixTextEncoding, "ISO-8859-1", strings.NewReader("Café\n"))
+		alternative := NewMultipartMessage("alternative", "==GoMultipartBoundary:1.")
+		alternative.AddPart(NewTextMessage(qprintable.UnixTextEncoding, strings.NewReader(text)))
+		alternative.AddPart(latin1)
+		m := NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+		m.EOL = eol
+		m.SetTextHeader("Subject", "Réunion à 10h")
+		m.AddPart(&alternative.Message)
+		m.AddPart(&NewMultipartMessage("related", "==GoMultipartBoundary:2.").Message)
+		m.Attach(&Attachment{Filename: "data.bin", MediaType: NewMediaType("application", "octet-stream")}, bytes.NewReader(data))
+		expected := readAll(t, m)
+
+		// Same message, with the writer
+		buf := bytes.NewBuffer(nil)
+		w := NewWriter(buf, "mixed", "==GoMultipartBoundary:0.")
+		w.Message.EOL = eol
+		w.Message.SetTextHeader("Subject", "Réunion à 10h")
+
+		aw, err := w.CreateMultipart("alternative", "==GoMultipartBoundary:1.")
+		if err != nil {
+			t.Fatalf("Can't create multipart: %v", err)
+		}
+		pw, _ := aw.CreatePart(NewTextMessage(qprintable.UnixTextEncoding, nil))
+		for _, line := range strings.SplitAfter(text, "\n") {
+			io.WriteString(pw, line)
+		}
+		pw.Close()
+		latin1, _ = NewTextMessageCharset(qprintable.UnixTextEncoding, "ISO-8859-1", nil)
+		pw, _ = aw.CreatePart(latin1)
+		io.WriteString(pw, "Café\n")
+		// not closed, closed by the next part
+
+		if _, err = w.CreateMultipart("related", "==GoMultipartBoundary:2."); err != nil {
+			t.Fatalf("Can't create multipart: %v", err)
+		}
+
+		pw, _ = w.CreatePart(NewAttachment(&Attachment{Filename: "data.bin", MediaType: NewMediaType("application", "octet-stream")}, nil))
+		for i := 0; i < len(data); i += 100 {
+			pw.Write(data[i : i+100])
+		}
+		if err = w.Close(); err != nil {
+			t.Fatalf("Can't close writer: %v", err)
+		}
+
+		if buf.String() != expected {
+			t.Errorf("Writer gives %#v, expected %#v", buf.String(), expected)
+		}
+		if _, err = pw.Write([]byte("more")); err != WriterClosed {
+			t.Errorf("Expected WriterClosed error, got %v", err)
+		}
+	}
+}
+
+func TestWriterAutoMessage(t *testing.T) {
+	// Templates whose line breaks are converted (7bit text, and text chosen as base64)
+	bodies := []struct {
+		qpEncoding *qprintable.Encoding
+		body       string
+	}{
+		{qprintable.UnixTextEncoding, "Hello,\nworld\n"},
+		{qprintable.UnixTextEncoding, "日本語\n日本語\n"},
+		{qprintable.WindowsTextEncoding, "Hello,\r\nworld\r\n"},
+		{qprintable.WindowsTextEncoding, "日本語\r\n日本語\r\n"},
+	}
+	for _, eol := range []string{"\r\n", "\n"} {
+		m := NewMultipartMessage("mixed", "==GoMultipartBoundary:0.")
+		m.EOL = eol
+		for _, b := range bodies {
+			part, err := NewAutoMessage(b.qpEncoding, strings.NewReader(b.body))
+			if err != nil {
+				t.Fatalf("Can't create message: %v", err)
+			}
+			m.AddPart(part)
+		}
+		expected := readAll(t, m)
+
+		buf := bytes.NewBuffer(nil)
+		w := NewWriter(buf, "mixed", "==GoMultipartBoundary:0.")
+		w.Message.EOL = eol
+		for _, b := range bodies {
+			part, _ := NewAutoMessage(b.qpEncoding, strings.NewReader(b.body))
+			pw, err := w.CreatePart(part)
+			if err != nil {
+				t.Fatalf("Can't create part: %v", err)
+			}
+			// Byte by byte, so that line breaks are split between writes
+			for i := 0; i < len(b.body); i++ {
+				pw.Write([]byte{b.body[i]})
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Can't close writer: %v", err)
+		}
+		if buf.String() != expected {
+			t.Errorf("Writer gives %#v, expected %#v", buf.String(), expected)
+		}
+	}
+}